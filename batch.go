@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// uploadBatch uploads files found from a directory or glob as they are found
+// and prints a summary, returning an error if any of them failed or not every
+// file could be found. Failures are also written to reportPath when it is
+// set. Files of an input list are reported with the line they were listed
+// on. The totals are timed from started, when the run began.
+func uploadBatch(ctx context.Context, uploader *stitch.Uploader, cfg stitch.UploadConfiguration, found batchFiles, state *uploadState, metrics *uploadMetrics, reportPath string, started time.Time) error {
+	batch := uploader.UploadFileStream(ctx, cfg, found.files)
+	skipped, findErr := found.wait()
+
+	for _, file := range batch.Files {
+		metrics.uploadFinished(file.Err)
+	}
+
+	if state != nil {
+		for _, file := range batch.Uploaded {
+			state.record(file.FileUpload, file.Result)
+		}
+
+		saveState(state)
+	}
+
+	var timings []stitch.PartTiming
+	for _, file := range batch.Uploaded {
+		timings = append(timings, file.Result.PartTimings...)
+	}
+	printTimingSummary(stderr, timings)
+
+	if reportPath != "" {
+		if err := writeFailureReport(reportPath, batch, found.lines); err != nil {
+			return err
+		}
+	}
+
+	uploaded, present := 0, 0
+	var bytes int64
+
+	for _, file := range batch.Uploaded {
+		if file.Result.Skipped {
+			present++
+		} else {
+			uploaded++
+			bytes += file.Result.TotalBytes
+		}
+	}
+
+	summary := newTransferSummary(bytes, started)
+
+	if jsonOutput {
+		results := make([]any, 0, len(batch.Files)+1)
+
+		for _, file := range batch.Files {
+			r := newJSONResult(cfg.Bucket, file.Key, file.Result, file.Err, file.Duration)
+			r.File = file.FilePath
+			r.Line = found.lines[file.FileUpload]
+			results = append(results, r)
+		}
+
+		if err := writeJSON(append(results, summary.json())); err != nil {
+			return err
+		}
+
+		return batchError(batch, findErr)
+	}
+
+	fmt.Fprintf(stdout, "Uploaded %d files, skipped %d, failed %d in %v\n",
+		uploaded, len(skipped)+present, len(batch.Failed), round(summary.elapsed))
+	fmt.Fprintln(stdout, summary)
+
+	printBatchTable(stderr, batch, skipped)
+	printFailedLines(stderr, batch, found.lines)
+
+	return batchError(batch, findErr)
+}
+
+// printBatchTable lists every file of the batch in the order it was given,
+// followed by the files skipped before uploading, each already described with
+// the reason it was skipped
+func printBatchTable(w io.Writer, batch *stitch.BatchResult, skipped []string) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "FILE\tSIZE\tPARTS\tDURATION\tTHROUGHPUT\tSTATUS")
+
+	for _, file := range batch.Files {
+		size, parts, status := "-", "-", "uploaded"
+
+		if info, err := os.Stat(file.FilePath); err == nil {
+			size = formatSize(float64(info.Size()))
+		}
+
+		switch {
+		case file.Err != nil:
+			status = "failed: " + file.Err.Error()
+		case file.Result.Skipped:
+			status = "skipped (already present)"
+		}
+
+		throughput := "-"
+		if file.Err == nil && !file.Result.Skipped {
+			parts = strconv.Itoa(file.Result.PartCount)
+
+			if seconds := file.Duration.Seconds(); seconds > 0 {
+				throughput = formatSize(float64(file.Result.TotalBytes)/seconds) + "/s"
+			}
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%v\t%s\t%s\n", file.FilePath, size, parts, file.Duration.Round(time.Millisecond), throughput, status)
+	}
+
+	for _, path := range skipped {
+		fmt.Fprintf(table, "%s\t-\t-\t-\t-\tskipped\n", path)
+	}
+
+	table.Flush()
+}
+
+// printFailedLines lists the input list lines whose files failed, so they can
+// be gathered into a list of their own and retried
+func printFailedLines(w io.Writer, batch *stitch.BatchResult, lines map[stitch.FileUpload]int) {
+	if lines == nil || len(batch.Failed) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Failed input list lines:")
+
+	for _, file := range batch.Failed {
+		fmt.Fprintf(w, "  line %d: %s: %v\n", lines[file.FileUpload], file.FilePath, file.Err)
+	}
+}
+
+// formatSize uses the same MB of 1024*1024 bytes as the progress bar
+func formatSize(bytes float64) string {
+	switch {
+	case bytes < 1024:
+		return fmt.Sprintf("%.0f B", bytes)
+	case bytes < 1024*1024:
+		return fmt.Sprintf("%.1f KB", bytes/1024)
+	}
+
+	return fmt.Sprintf("%.1f MB", bytes/(1024*1024))
+}
+
+// batchError wraps the first failure so the exit code reflects its class.
+// Failing to find every file comes first, since the batch is then incomplete
+// however the files found went.
+func batchError(batch *stitch.BatchResult, findErr error) error {
+	if findErr != nil {
+		return fmt.Errorf("stopped finding files after %d, of which %d failed to upload: %w", len(batch.Files), len(batch.Failed), findErr)
+	}
+
+	if len(batch.Failed) > 0 {
+		return fmt.Errorf("%d of %d files failed to upload, first: %w", len(batch.Failed), len(batch.Files), batch.Failed[0].Err)
+	}
+
+	return nil
+}
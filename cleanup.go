@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// cleanupUploads aborts the multipart uploads left behind by failed runs,
+// or with dryRun only lists them
+func cleanupUploads(ctx context.Context, uploader *stitch.Uploader, bucket string, keyPrefix string, olderThan time.Duration, dryRun bool) error {
+	stale, err := uploader.StaleUploads(ctx, bucket, keyPrefix, olderThan)
+
+	if err != nil {
+		return err
+	}
+
+	aborted := 0
+	var failed []error
+
+	for _, upload := range stale {
+		key := aws.ToString(upload.Key)
+		initiated := aws.ToTime(upload.Initiated).Format(time.RFC3339)
+
+		if dryRun {
+			fmt.Fprintf(stdout, "Would abort s3://%s/%s, upload %s started %s\n", bucket, key, aws.ToString(upload.UploadId), initiated)
+			continue
+		}
+
+		if err := uploader.AbortStaleUpload(ctx, bucket, upload); err != nil {
+			fmt.Fprintf(stdout, "  failed: s3://%s/%s: %v\n", bucket, key, err)
+			failed = append(failed, err)
+			continue
+		}
+
+		fmt.Fprintf(stdout, "Aborted s3://%s/%s, upload %s started %s\n", bucket, key, aws.ToString(upload.UploadId), initiated)
+		aborted++
+	}
+
+	if dryRun {
+		fmt.Fprintf(stdout, "Found %d uploads older than %v\n", len(stale), olderThan)
+		return nil
+	}
+
+	fmt.Fprintf(stdout, "Aborted %d of %d uploads older than %v\n", aborted, len(stale), olderThan)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d uploads could not be aborted, first: %w", len(failed), failed[0])
+	}
+
+	return nil
+}
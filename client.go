@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+type clientOptions struct {
+	endpoint  string
+	pathStyle bool
+	region    string
+	profile   string
+
+	// useFIPS and useDualstack pick the FIPS 140 and IPv6 capable endpoints
+	useFIPS      bool
+	useDualstack bool
+
+	// accelerate sends requests through the bucket's Transfer Acceleration
+	// endpoint
+	accelerate bool
+
+	// credentialsFile and configFile replace the shared files in ~/.aws when
+	// set, and with them AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE
+	credentialsFile string
+	configFile      string
+
+	// Static credentials replace the default chain when accessKeyId is set
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+
+	// roleArn is assumed with whichever credentials were loaded above
+	roleArn         string
+	roleSessionName string
+	externalId      string
+
+	// retryMode and maxAttempts tune the SDK's own retries, overriding
+	// AWS_RETRY_MODE and AWS_MAX_ATTEMPTS when set. They sit beneath
+	// -maxRetries: every part attempt stitch makes is itself up to maxAttempts
+	// SDK attempts, so the worst case is their product.
+	retryMode   aws.RetryMode
+	maxAttempts int
+}
+
+// Environment variables that supply the static credentials when their flags
+// are omitted, keeping secrets off the command line
+const (
+	accessKeyIdEnv     = "STITCH_ACCESS_KEY_ID"
+	secretAccessKeyEnv = "STITCH_SECRET_ACCESS_KEY"
+	sessionTokenEnv    = "STITCH_SESSION_TOKEN"
+)
+
+// credentialsExpiryWindow refreshes temporary credentials this long before
+// they expire, so a part is never signed with a token about to run out
+const credentialsExpiryWindow = 5 * time.Minute
+
+// minRefreshInterval stops part workers that all hit an expired token at once
+// from each fetching new credentials
+const minRefreshInterval = 10 * time.Second
+
+// initializeClient returns the S3 client along with a function that replaces
+// its cached credentials, for stitch.Uploader.RefreshCredentials
+func initializeClient(ctx context.Context, opts clientOptions) (*s3.Client, func(context.Context) error, error) {
+	// Explicit options take precedence over AWS_REGION and AWS_PROFILE
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithCredentialsCacheOptions(func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialsExpiryWindow
+		}),
+	}
+
+	if opts.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(opts.region))
+	}
+
+	if opts.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(opts.profile))
+	}
+
+	if opts.credentialsFile != "" {
+		loadOptions = append(loadOptions, config.WithSharedCredentialsFiles([]string{opts.credentialsFile}))
+	}
+
+	if opts.configFile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigFiles([]string{opts.configFile}))
+	}
+
+	if opts.retryMode != "" {
+		loadOptions = append(loadOptions, config.WithRetryMode(opts.retryMode))
+	}
+
+	if opts.maxAttempts > 0 {
+		loadOptions = append(loadOptions, config.WithRetryMaxAttempts(opts.maxAttempts))
+	}
+
+	if opts.accessKeyId != "" {
+		loadOptions = append(loadOptions, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(opts.accessKeyId, opts.secretAccessKey, opts.sessionToken)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	if opts.roleArn != "" {
+		sessionName := opts.roleSessionName
+		if sessionName == "" {
+			sessionName = fmt.Sprintf("stitch-%d", time.Now().Unix())
+		}
+
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.roleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+			o.ExternalID = optionalString(opts.externalId)
+		})
+
+		cfg.Credentials = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialsExpiryWindow
+		})
+
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to assume role %s: %v", errCredentials, opts.roleArn, err)
+		}
+
+		slog.Info("Assumed role", "roleArn", opts.roleArn, "sessionName", sessionName)
+	}
+
+	// Resolving credentials up front reports a missing or broken setup as such
+	// rather than as the first request failing. The result is cached for the
+	// client.
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errCredentials, err)
+	}
+
+	slog.Info("Loaded AWS config", "region", cfg.Region, "profile", effectiveProfile(opts.profile))
+
+	if opts.useFIPS && !fipsRegions[cfg.Region] {
+		return nil, nil, usagef("S3 has no FIPS endpoint in region %q, use -region with one of %s", cfg.Region, fipsRegionList())
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.endpoint)
+		}
+
+		o.UsePathStyle = opts.pathStyle
+
+		if opts.useFIPS {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+
+		if opts.useDualstack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+
+		o.UseAccelerate = opts.accelerate
+	})
+
+	return client, credentialsRefresher(cfg.Credentials), nil
+}
+
+// uploadClient is the client an upload to bucket, and to every other one of
+// dests, sends its requests through, along with what refreshes its
+// credentials. With presignURL the requests go through that service instead,
+// without any credentials of their own.
+func uploadClient(ctx context.Context, opts clientOptions, presignURL string, bucket string, dests []stitch.Destination, autoRegion bool) (stitch.S3MultipartAPI, func(context.Context) error, error) {
+	if presignURL != "" {
+		return newPresignClient(presignURL, os.Getenv(presignTokenEnv)), nil, nil
+	}
+
+	client, refresh, err := initializeClient(ctx, opts)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bucketClient, err := clientForBucket(ctx, client, bucket, autoRegion)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := destinationClients(ctx, client, dests, autoRegion); err != nil {
+		return nil, nil, err
+	}
+
+	return bucketClient, refresh, nil
+}
+
+// credentialsRefresher invalidates the cached credentials and fetches new
+// ones, at most once every minRefreshInterval
+func credentialsRefresher(provider aws.CredentialsProvider) func(context.Context) error {
+	cache, ok := provider.(*aws.CredentialsCache)
+
+	if !ok {
+		return nil
+	}
+
+	var mu sync.Mutex
+	var last time.Time
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Since(last) < minRefreshInterval {
+			return nil
+		}
+
+		slog.Info("Refreshing AWS credentials")
+		cache.Invalidate()
+
+		if _, err := cache.Retrieve(ctx); err != nil {
+			return fmt.Errorf("%w: %v", errCredentials, err)
+		}
+
+		last = time.Now()
+		return nil
+	}
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+// valueOrEnv returns value, falling back to the named environment variable
+func valueOrEnv(value string, env string) string {
+	if value != "" {
+		return value
+	}
+
+	return os.Getenv(env)
+}
+
+func effectiveProfile(profile string) string {
+	if profile != "" {
+		return profile
+	}
+
+	if env := os.Getenv("AWS_PROFILE"); env != "" {
+		return env
+	}
+
+	return "default"
+}
+
+// fipsRegions are the regions where S3 has FIPS endpoints
+var fipsRegions = map[string]bool{
+	"us-east-1":     true,
+	"us-east-2":     true,
+	"us-west-1":     true,
+	"us-west-2":     true,
+	"us-gov-east-1": true,
+	"us-gov-west-1": true,
+	"ca-central-1":  true,
+	"ca-west-1":     true,
+}
+
+func fipsRegionList() string {
+	return strings.Join(slices.Sorted(maps.Keys(fipsRegions)), ", ")
+}
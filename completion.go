@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// completionRecord is what -noComplete leaves for another party to complete
+// the upload with: the upload and its parts in part number order, as
+// CompleteMultipartUpload takes them
+type completionRecord struct {
+	Bucket            string                  `json:"bucket"`
+	Key               string                  `json:"key"`
+	UploadId          string                  `json:"uploadId"`
+	ChecksumAlgorithm types.ChecksumAlgorithm `json:"checksumAlgorithm,omitempty"`
+	Parts             []completionPart        `json:"parts"`
+}
+
+type completionPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+	// Checksum is needed to complete an upload started with a checksum
+	// algorithm
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func newCompletionRecord(cfg stitch.UploadConfiguration, result *stitch.UploadResult) completionRecord {
+	record := completionRecord{
+		Bucket:            cfg.Bucket,
+		Key:               cfg.Key,
+		UploadId:          result.UploadId,
+		ChecksumAlgorithm: cfg.ChecksumAlgorithm,
+		Parts:             make([]completionPart, 0, len(result.Parts)),
+	}
+
+	for _, part := range result.Parts {
+		entry := completionPart{PartNumber: aws.ToInt32(part.PartNumber), ETag: aws.ToString(part.ETag)}
+
+		for _, checksum := range []*string{part.ChecksumCRC32, part.ChecksumCRC32C, part.ChecksumSHA1, part.ChecksumSHA256} {
+			if checksum != nil {
+				entry.Checksum = *checksum
+			}
+		}
+
+		record.Parts = append(record.Parts, entry)
+	}
+
+	return record
+}
+
+// writeCompletion writes the record to path, or as the JSON output when path
+// is empty, since the record is then the whole result of the run
+func writeCompletion(record completionRecord, path string) error {
+	if path == "" {
+		return writeJSON(record)
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("failed to encode completion file: %v", err)
+	}
+
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write completion file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigName is loaded from the home directory when -config isn't given
+const defaultConfigName = ".stitch.yaml"
+
+// configKeys are the flags a config file may supply defaults for
+var configKeys = map[string]bool{
+	"bucket":       true,
+	"keyPrefix":    true,
+	"chunkSize":    true,
+	"storageClass": true,
+	"sse":          true,
+	"region":       true,
+	"concurrency":  true,
+}
+
+// applyConfigFile sets flags from a YAML file of flag names and values, such
+// as "bucket: my-bucket". Flags given on the command line keep their values.
+// Without an explicit path, ~/.stitch.yaml is used if it exists.
+func applyConfigFile(path string) error {
+	explicit := path != ""
+
+	if !explicit {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return nil
+		}
+
+		path = filepath.Join(home, defaultConfigName)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	values := map[string]any{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	provided := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		provided[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !configKeys[name] {
+			slog.Warn("Ignoring unknown config file key", "file", path, "key", name)
+			continue
+		}
+
+		if provided[name] {
+			continue
+		}
+
+		if err := flag.Set(name, fmt.Sprint(values[name])); err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+
+	slog.Debug("Loaded config file", "file", path)
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// batchFiles are the files of a glob or directory to upload, sent on files as
+// they are found. wait is called once files is closed and returns the entries
+// skipped and the error finding files stopped at, if any. lines, for an
+// input list, has the line each file was listed on.
+type batchFiles struct {
+	files <-chan stitch.FileUpload
+	wait  func() ([]string, error)
+	lines map[stitch.FileUpload]int
+}
+
+// batchInput finds the files of a directory, glob or input list to upload to
+// bucket, each keyed below prefix by keys. Those of a glob or input list are
+// listed before uploading, while those of dir are found as they upload.
+type batchInput struct {
+	bucket         string
+	dir            string
+	prefix         string
+	keys           *fileKeys
+	followSymlinks bool
+	force          bool
+
+	// files are those listed still to upload, with the line of the input
+	// list each was given on and the entries left out
+	files   []stitch.FileUpload
+	lines   map[stitch.FileUpload]int
+	skipped []string
+}
+
+// list reads the files of inputList, or without one of the glob filePath
+func (in *batchInput) list(filePath string, inputList string) error {
+	if inputList != "" {
+		entries, err := readInputList(inputList, in.prefix)
+
+		if err != nil {
+			return failure(in.bucket, inputList, err)
+		}
+
+		in.files, in.lines, err = keyListEntries(entries, in.keys)
+		return err
+	}
+
+	globbed, err := stitch.GlobFiles(filePath, in.prefix)
+
+	if err != nil {
+		return failure(in.bucket, filePath, err)
+	}
+
+	in.files, err = in.keys.keyAll(globbed)
+	return err
+}
+
+// leaveUnchanged leaves out the listed files state records as unchanged since
+// their last upload. Those of a directory are left out as they are found.
+func (in *batchInput) leaveUnchanged(state *uploadState) error {
+	if in.dir != "" {
+		return nil
+	}
+
+	pending, unchanged, err := state.pending(in.bucket, in.files, in.force)
+
+	if err != nil {
+		return err
+	}
+
+	in.files = pending
+
+	for _, path := range unchanged {
+		in.skipped = append(in.skipped, path+" (unchanged since last upload)")
+	}
+
+	return nil
+}
+
+// found starts finding the files to upload, walking the directory in ctx
+func (in *batchInput) found(ctx context.Context, state *uploadState) batchFiles {
+	if in.dir != "" {
+		return directoryFiles(ctx, in.dir, in.prefix, in.followSymlinks, in.keys, state, in.bucket, in.force)
+	}
+
+	found := listedFiles(in.files, in.skipped)
+	found.lines = in.lines
+
+	return found
+}
+
+// listedFiles sends files that are already known, as those of a glob
+func listedFiles(files []stitch.FileUpload, skipped []string) batchFiles {
+	queued := make(chan stitch.FileUpload, len(files))
+
+	for _, file := range files {
+		queued <- file
+	}
+
+	close(queued)
+
+	return batchFiles{files: queued, wait: func() ([]string, error) { return skipped, nil }}
+}
+
+// directoryFiles walks dir while its files are uploaded, giving each its key
+// and, with state, leaving out those unchanged since their last upload as
+// they are found. The files found before an error are still uploaded.
+func directoryFiles(ctx context.Context, dir string, prefix string, followSymlinks bool, keys *fileKeys, state *uploadState, bucket string, force bool) batchFiles {
+	ctx, cancel := context.WithCancel(ctx)
+	found, walked := stitch.DirectoryFileStream(ctx, dir, prefix, followSymlinks)
+
+	files := make(chan stitch.FileUpload)
+	done := make(chan struct{})
+
+	var skipped []string
+	var err error
+
+	go func() {
+		defer close(done)
+		defer close(files)
+		defer cancel()
+
+		for file := range found {
+			// The walk stops once cancelled, this only drains what it found
+			if err != nil {
+				continue
+			}
+
+			file, keyErr := keys.key(file)
+
+			if keyErr != nil {
+				err = keyErr
+				cancel()
+				continue
+			}
+
+			if state != nil {
+				pending, unchanged, stateErr := state.pending(bucket, []stitch.FileUpload{file}, force)
+
+				if stateErr != nil {
+					err = stateErr
+					cancel()
+					continue
+				}
+
+				for _, path := range unchanged {
+					skipped = append(skipped, path+" (unchanged since last upload)")
+				}
+
+				if len(pending) == 0 {
+					continue
+				}
+			}
+
+			files <- file
+		}
+
+		walkSkipped, walkErr := walked()
+		skipped = append(walkSkipped, skipped...)
+
+		if err == nil {
+			err = walkErr
+		}
+	}()
+
+	return batchFiles{files: files, wait: func() ([]string, error) {
+		<-done
+		return skipped, err
+	}}
+}
+
+// collectFiles waits for every file of found, for a plan that needs them all
+func collectFiles(found batchFiles) ([]stitch.FileUpload, []string, error) {
+	var files []stitch.FileUpload
+
+	for file := range found.files {
+		files = append(files, file)
+	}
+
+	skipped, err := found.wait()
+
+	return files, skipped, err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+type jsonETag struct {
+	File      string `json:"file"`
+	ChunkSize int64  `json:"chunkSize"`
+	ETag      string `json:"etag"`
+}
+
+// printComputedETag prints the ETag uploader would give the object from
+// cfg.FilePath, to compare with the ETag of the object in S3
+func printComputedETag(uploader *stitch.Uploader, cfg stitch.UploadConfiguration) error {
+	etag, err := uploader.ObjectETag(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return writeJSON(jsonETag{File: cfg.FilePath, ChunkSize: cfg.ChunkSize, ETag: etag})
+	}
+
+	fmt.Fprintf(stdout, "%s etag=%s (chunk size %d)\n", cfg.FilePath, etag, cfg.ChunkSize)
+
+	return nil
+}
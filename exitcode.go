@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// Exit codes let scripts tell failure classes apart
+const (
+	// exitFailure is any failure not covered below
+	exitFailure = 1
+	// exitUsage is an invalid flag or flag combination
+	exitUsage = 2
+	// exitAuth is missing credentials or a request S3 denied
+	exitAuth = 3
+	// exitNetwork is a connection failure, timeout, or server error that
+	// outlasted every retry
+	exitNetwork = 4
+	// exitVerification is an object that doesn't match the local file after
+	// -verify
+	exitVerification = 5
+	// exitPrecondition is -ifMatch or -ifNoneMatch finding the object was
+	// changed or created by another writer
+	exitPrecondition = 6
+)
+
+// authErrorCodes are the S3 error codes for credentials or permissions
+var authErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccountProblem":        true,
+	"AllAccessDisabled":     true,
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"SignatureDoesNotMatch": true,
+	"TokenRefreshRequired":  true,
+}
+
+// errCredentials is wrapped when no usable AWS credentials could be found
+var errCredentials = errors.New("unable to load AWS credentials")
+
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+func usagef(format string, args ...any) error {
+	return usageError{message: fmt.Sprintf(format, args...)}
+}
+
+// exitCode maps the error that ended the run to one of the exit codes above
+func exitCode(err error) int {
+	var usage usageError
+	if errors.As(err, &usage) || errors.Is(err, stitch.ErrInvalidConfiguration) {
+		return exitUsage
+	}
+
+	if errors.Is(err, stitch.ErrVerificationFailed) {
+		return exitVerification
+	}
+
+	if errors.Is(err, stitch.ErrPreconditionFailed) {
+		return exitPrecondition
+	}
+
+	if isAuthError(err) {
+		return exitAuth
+	}
+
+	if isNetworkError(err) {
+		return exitNetwork
+	}
+
+	return exitFailure
+}
+
+func isAuthError(err error) bool {
+	if errors.Is(err, errCredentials) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && authErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		status := responseErr.HTTPStatusCode()
+		return status == http.StatusUnauthorized || status == http.StatusForbidden
+	}
+
+	return false
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	var attemptsErr *retry.MaxAttemptsError
+	if errors.As(err, &netErr) || errors.As(err, &attemptsErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err).Bool()
+}
+
+// accessDeniedHint explains S3 denying access, which it does with a plain 403
+// both for a Requester Pays bucket without -requestPayer and for a bucket
+// owned by another account than -expectedBucketOwner. The latter is reported
+// as a bucket owner mismatch.
+func accessDeniedHint(cfg stitch.UploadConfiguration, err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDenied" {
+		return err
+	}
+
+	if !cfg.RequestPayer {
+		slog.Warn("Access denied, if the bucket is Requester Pays retry with -requestPayer", "bucket", cfg.Bucket)
+	}
+
+	if cfg.ExpectedBucketOwner != "" {
+		return fmt.Errorf("bucket owner mismatch: bucket %s may not belong to account %s, or access to it was denied: %w",
+			cfg.Bucket, cfg.ExpectedBucketOwner, err)
+	}
+
+	return err
+}
+
+// hiddenFlags are left out of the usage, being meant for testing rather than
+// for uploads
+var hiddenFlags = map[string]bool{
+	"partSizes": true,
+}
+
+// usageWithExitCodes is flag.Usage with the exit codes and signals listed
+// after the flags
+func usageWithExitCodes() {
+	output := flag.CommandLine.Output()
+
+	fmt.Fprintf(output, "Usage of %s:\n", flag.CommandLine.Name())
+
+	visible := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	visible.SetOutput(output)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+
+	visible.PrintDefaults()
+
+	fmt.Fprintf(output, `
+Exit codes:
+  %d  upload failed
+  %d  invalid flags
+  %d  missing credentials or access denied
+  %d  network error, timeout, or server error after all retries
+  %d  -verify found the object doesn't match the local file
+  %d  -ifMatch or -ifNoneMatch found the object changed or already exists
+
+Signals:
+  SIGUSR1  pause the upload, keeping it open, or resume it when paused
+  SIGUSR2  resume a paused upload
+`, exitFailure, exitUsage, exitAuth, exitNetwork, exitVerification, exitPrecondition)
+}
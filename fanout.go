@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// parseDestinations parses -dest values of the form bucket:key, normalizing
+// their keys unless rawKey is set
+func parseDestinations(values []string, rawKey bool) ([]stitch.Destination, error) {
+	dests := make([]stitch.Destination, 0, len(values))
+
+	for _, value := range values {
+		bucket, key, ok := strings.Cut(value, ":")
+
+		if !ok || bucket == "" || key == "" {
+			return nil, usagef("-dest %q must be in the form bucket:key", value)
+		}
+
+		if isKeyTemplate(key) {
+			return nil, usagef("-dest keys can't be templates")
+		}
+
+		if !rawKey {
+			key = normalizedKey(key)
+		}
+
+		dests = append(dests, stitch.Destination{Bucket: bucket, Key: key})
+	}
+
+	return dests, nil
+}
+
+// destinationClients gives every destination after the first a client for
+// its bucket's region. The first is -bucket's, whose client is already set
+// up for it.
+func destinationClients(ctx context.Context, client *s3.Client, dests []stitch.Destination, autoRegion bool) error {
+	for i := 1; i < len(dests); i++ {
+		bucketClient, err := clientForBucket(ctx, client, dests[i].Bucket, autoRegion)
+
+		if err != nil {
+			return err
+		}
+
+		dests[i].Client = bucketClient
+	}
+
+	return nil
+}
+
+// uploadFanOut uploads the file to every destination and prints the outcome
+// of each, returning an error if any of them failed. The total sent to every
+// destination is timed from started, when the run began.
+func uploadFanOut(ctx context.Context, uploader *stitch.Uploader, cfg stitch.UploadConfiguration, dests []stitch.Destination, bestEffort bool, metrics *uploadMetrics, started time.Time) error {
+	start := time.Now()
+
+	results, err := uploader.UploadFanOut(ctx, cfg, dests, bestEffort)
+
+	for _, result := range results {
+		metrics.uploadFinished(result.Err)
+	}
+
+	var uploaded []stitch.DestinationResult
+	var failed []stitch.DestinationResult
+	var bytes int64
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		} else {
+			uploaded = append(uploaded, result)
+			bytes += result.Result.TotalBytes
+		}
+	}
+
+	summary := newTransferSummary(bytes, started)
+
+	if jsonOutput {
+		out := make([]any, 0, len(results)+1)
+
+		for _, result := range results {
+			r := newJSONResult(result.Bucket, result.Key, result.Result, result.Err, time.Since(start))
+			r.File = cfg.FilePath
+			out = append(out, r)
+		}
+
+		if writeErr := writeJSON(append(out, summary.json())); writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	if len(results) == 0 {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Uploaded to %d of %d destinations in %v\n", len(uploaded), len(results), time.Since(start).Round(time.Millisecond))
+
+	for _, result := range uploaded {
+		fmt.Fprintln(stdout, "  uploaded:", objectLine(result.Bucket, result.Key, result.Result.ETag))
+	}
+
+	for _, result := range failed {
+		fmt.Fprintf(stdout, "  failed: %s: %v\n", objectURI(result.Bucket, result.Key), result.Err)
+	}
+
+	if len(uploaded) > 0 {
+		fmt.Fprintln(stdout, partsLine(uploaded[0].Result))
+		fmt.Fprintln(stdout, "SHA-256: ", uploaded[0].Result.SHA256)
+	}
+
+	fmt.Fprintln(stdout, summary)
+
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// keyValueFlag collects repeated key=value flags into a map
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := make([]string, 0, len(f))
+
+	for _, key := range slices.Sorted(maps.Keys(f)) {
+		pairs = append(pairs, key+"="+f[key])
+	}
+
+	return strings.Join(pairs, ", ")
+}
+
+func (f keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+
+	if !ok {
+		return fmt.Errorf("%q must be in the form key=value", value)
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return fmt.Errorf("%q has an empty key", value)
+	}
+
+	f[key] = val
+	return nil
+}
+
+// listFlag collects every value of a repeated flag
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// sizeListFlag is a comma separated list of sizes, each parsed like a
+// byteSize flag
+type sizeListFlag []int64
+
+func (f *sizeListFlag) String() string {
+	sizes := make([]string, len(*f))
+	for i, size := range *f {
+		sizes[i] = strconv.FormatInt(size, 10)
+	}
+
+	return strings.Join(sizes, ",")
+}
+
+func (f *sizeListFlag) Set(value string) error {
+	*f = nil
+
+	for _, item := range strings.Split(value, ",") {
+		size, err := parseByteSize(item)
+
+		if err != nil {
+			return err
+		}
+
+		*f = append(*f, size)
+	}
+
+	return nil
+}
+
+// byteSizeFlag is an int64 flag set from a human-readable size, parsed by
+// parse, with plain byte counts still accepted
+type byteSizeFlag struct {
+	value *int64
+	parse func(string) (int64, error)
+}
+
+func (f byteSizeFlag) String() string {
+	if f.value == nil {
+		return "0"
+	}
+
+	return strconv.FormatInt(*f.value, 10)
+}
+
+func (f byteSizeFlag) Set(value string) error {
+	n, err := f.parse(value)
+
+	if err != nil {
+		return err
+	}
+
+	*f.value = n
+	return nil
+}
+
+// byteSize defines a size flag such as 15MB or 1GiB, like flag.Int64
+func byteSize(name string, value int64, usage string) *int64 {
+	p := &value
+	flag.Var(byteSizeFlag{value: p, parse: parseByteSize}, name, usage)
+
+	return p
+}
+
+// byteRate defines a throughput flag such as 10MB/s in bytes per second
+func byteRate(name string, value int64, usage string) *int64 {
+	p := &value
+	flag.Var(byteSizeFlag{value: p, parse: parseRate}, name, usage)
+
+	return p
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1000,
+	"KB":  1000,
+	"M":   1000 * 1000,
+	"MB":  1000 * 1000,
+	"G":   1000 * 1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"KIB": 1024,
+	"MIB": 1024 * 1024,
+	"GIB": 1024 * 1024 * 1024,
+}
+
+// parseByteSize parses sizes such as 1048576, 500K, 15MB or 1GiB into bytes
+func parseByteSize(value string) (int64, error) {
+	trimmed := strings.TrimSpace(value)
+	split := strings.IndexFunc(trimmed, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+
+	number, unit := trimmed, ""
+	if split >= 0 {
+		number, unit = trimmed[:split], strings.TrimSpace(trimmed[split:])
+	}
+
+	multiplier, ok := sizeUnits[strings.ToUpper(unit)]
+
+	if !ok {
+		return 0, fmt.Errorf("%q has an unknown size unit %q, use B, K, KB, M, MB, G, GB, KiB, MiB, or GiB", value, unit)
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", value)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// parseRate parses a throughput such as 10MB/s into bytes per second
+func parseRate(value string) (int64, error) {
+	return parseByteSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+}
+
+// parseExpiry parses an RFC 3339 time, or a duration such as 72h counted from
+// now
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration such as 72h", value)
+	}
+
+	return t, nil
+}
+
+// flagProvided reports whether the named flag was set on the command line
+func flagProvided(name string) bool {
+	provided := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			provided = true
+		}
+	})
+
+	return provided
+}
+
+// parseChecksumFlags parses -checksumAlgorithm and -checksumMode, with a usage
+// error for a combination S3 can't take, such as -contentMD5 with an algorithm
+func parseChecksumFlags(algorithm string, mode string, contentMD5 bool) (types.ChecksumAlgorithm, stitch.ChecksumMode, error) {
+	var parsed types.ChecksumAlgorithm
+	if algorithm != "" {
+		value, err := stitch.ParseChecksumAlgorithm(algorithm)
+
+		if err != nil {
+			return "", "", usagef("-checksumAlgorithm: %v", err)
+		}
+
+		parsed = value
+	}
+
+	parsedMode, err := stitch.ParseChecksumMode(mode)
+
+	if err != nil {
+		return "", "", usagef("-checksumMode: %v", err)
+	}
+
+	if parsedMode == stitch.ChecksumModeTrailer && parsed == "" {
+		return "", "", usagef("-checksumMode trailer requires -checksumAlgorithm")
+	}
+
+	if contentMD5 && parsed != "" {
+		return "", "", usagef("-contentMD5 and -checksumAlgorithm can't be used together")
+	}
+
+	return parsed, parsedMode, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// listEntry is a file named by a line of the -inputList manifest
+type listEntry struct {
+	stitch.FileUpload
+
+	line int
+	// keyGiven is set when the line gives the key after a tab, which is then
+	// used as is rather than from -keyPrefix or a -key template
+	keyGiven bool
+}
+
+// readInputList reads the manifest at path, or standard input for -. Each
+// line is a file path, optionally followed by a tab and the key to upload it
+// to, otherwise it is keyed by prefix and its base name like a glob's files.
+// Blank lines and those starting with # are skipped.
+func readInputList(path string, prefix string) ([]listEntry, error) {
+	var r io.Reader = os.Stdin
+
+	if path != stitch.StdinPath {
+		f, err := os.Open(path)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input list: %v", err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var entries []listEntry
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		file, key, keyGiven := strings.Cut(text, "\t")
+		file = strings.TrimSpace(file)
+
+		if !keyGiven {
+			key = prefix + filepath.Base(file)
+		} else if key = strings.TrimSpace(key); key == "" {
+			return nil, usagef("input list line %d gives an empty key for %s", line, file)
+		}
+
+		entries = append(entries, listEntry{FileUpload: stitch.FileUpload{FilePath: file, Key: key}, line: line, keyGiven: keyGiven})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input list: %v", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, usagef("input list %s names no files", path)
+	}
+
+	return entries, nil
+}
+
+// keyListEntries keys the files of the list like those of a glob, except
+// those given a key in the list, which are only normalized and suffixed. It
+// returns the line each file was listed on alongside.
+func keyListEntries(entries []listEntry, keys *fileKeys) ([]stitch.FileUpload, map[stitch.FileUpload]int, error) {
+	givenKeys := &fileKeys{suffix: keys.suffix, normalize: keys.normalize}
+
+	files := make([]stitch.FileUpload, 0, len(entries))
+	lines := make(map[stitch.FileUpload]int, len(entries))
+
+	for _, entry := range entries {
+		keyer := keys
+		if entry.keyGiven {
+			keyer = givenKeys
+		}
+
+		file, err := keyer.key(entry.FileUpload)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("input list line %d: %w", entry.line, err)
+		}
+
+		files = append(files, file)
+		lines[file] = entry.line
+	}
+
+	return files, lines, nil
+}
@@ -0,0 +1,103 @@
+//go:build integration
+
+package main
+
+// Like the stitch package's integration tests, these run against the S3
+// compatible endpoint named by STITCH_INTEGRATION_ENDPOINT and are skipped
+// without it
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+func TestIntegrationEndpointRoundTrip(t *testing.T) {
+	endpoint := os.Getenv("STITCH_INTEGRATION_ENDPOINT")
+
+	if endpoint == "" {
+		t.Skip("STITCH_INTEGRATION_ENDPOINT is not set")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	ctx := context.Background()
+
+	client, _, err := initializeClient(ctx, clientOptions{endpoint: endpoint, pathStyle: true, region: region})
+
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	bucket := fmt.Sprintf("stitch-it-%d", time.Now().UnixNano())
+
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		t.Fatalf("failed to create bucket %s: %v", bucket, err)
+	}
+
+	key := "endpoint/round-trip.bin"
+
+	t.Cleanup(func() {
+		client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &bucket, Key: &key})
+		client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: &bucket})
+	})
+
+	if _, err := checkBucket(ctx, client, bucket); err != nil {
+		t.Fatalf("failed to find bucket through the endpoint: %v", err)
+	}
+
+	data := make([]byte, 2*stitch.MinimumChunkSize+1000)
+	rand.Read(data)
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := stitch.NewUploader(client).Upload(ctx, stitch.UploadConfiguration{
+		Bucket:    bucket,
+		Key:       key,
+		FilePath:  path,
+		ChunkSize: stitch.MinimumChunkSize,
+		Verify:    true,
+	})
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if result.PartCount != 3 {
+		t.Errorf("uploaded %d parts, want 3", result.PartCount)
+	}
+
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+
+	if err != nil {
+		t.Fatalf("failed to download object: %v", err)
+	}
+	defer resp.Body.Close()
+
+	downloaded, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatalf("failed to download object: %v", err)
+	}
+
+	if !bytes.Equal(downloaded, data) {
+		t.Error("downloaded object doesn't match the file")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// normalizeKey strips leading slashes and collapses repeated ones, which S3
+// would otherwise keep as folders with empty names
+func normalizeKey(key string) string {
+	key = strings.TrimLeft(key, "/")
+
+	for strings.Contains(key, "//") {
+		key = strings.ReplaceAll(key, "//", "/")
+	}
+
+	return key
+}
+
+// normalizedKey is normalizeKey, logging the change when there is one
+func normalizedKey(key string) string {
+	normalized := normalizeKey(key)
+
+	if normalized != key {
+		slog.Info("Normalized key, use -rawKey to keep it as given", "key", key, "normalized", normalized)
+	}
+
+	return normalized
+}
+
+// fileKeys turns the key a glob or directory file is found with into the key
+// it is uploaded to, one file at a time as they are found
+type fileKeys struct {
+	// tmpl, when set, replaces the key, which is the file's path below the
+	// directory, with the rendered template
+	tmpl      *keyTemplate
+	suffix    string
+	normalize bool
+
+	logged bool
+}
+
+// key rewrites the file's key. Only the first normalized key is logged,
+// since a prefix changes them all alike.
+func (k *fileKeys) key(file stitch.FileUpload) (stitch.FileUpload, error) {
+	if k.tmpl != nil {
+		rendered, err := k.tmpl.render(file.FilePath, file.Key)
+
+		if err != nil {
+			return file, usagef("%v", err)
+		}
+
+		file.Key = rendered
+	}
+
+	file.Key += k.suffix
+
+	if !k.normalize {
+		return file, nil
+	}
+
+	normalized := normalizeKey(file.Key)
+
+	if normalized != file.Key && !k.logged {
+		slog.Info("Normalized keys, use -rawKey to keep them as given", "key", file.Key, "normalized", normalized)
+		k.logged = true
+	}
+
+	file.Key = normalized
+
+	return file, nil
+}
+
+// keyAll rewrites the key of every file, as key does
+func (k *fileKeys) keyAll(files []stitch.FileUpload) ([]stitch.FileUpload, error) {
+	keyed := make([]stitch.FileUpload, 0, len(files))
+
+	for _, file := range files {
+		file, err := k.key(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keyed = append(keyed, file)
+	}
+
+	return keyed, nil
+}
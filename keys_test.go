@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+func TestFileKeysKeepNestedPaths(t *testing.T) {
+	for _, tc := range []struct {
+		key       string
+		normalize bool
+		want      string
+	}{
+		{"backup/a/b/c/file.txt", true, "backup/a/b/c/file.txt"},
+		{"/backup//a/b///c/file.txt", true, "backup/a/b/c/file.txt"},
+		{"/backup//a/b///c/file.txt", false, "/backup//a/b///c/file.txt"},
+	} {
+		keys := &fileKeys{suffix: ".gz", normalize: tc.normalize}
+
+		file, err := keys.key(stitch.FileUpload{FilePath: "file.txt", Key: tc.key})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tc.want + ".gz"; file.Key != want {
+			t.Errorf("key %q became %q, want %q", tc.key, file.Key, want)
+		}
+	}
+}
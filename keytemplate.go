@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// keyData are the variables available to a -key template
+type keyData struct {
+	// Filename is the file's base name, and Ext its extension including the
+	// dot. Both are empty when reading from stdin.
+	Filename string
+	Ext      string
+	// Path is the file's path below the directory for a directory upload,
+	// which keeps keys apart for files of the same name in different
+	// subdirectories. It is Filename otherwise.
+	Path string
+	// Date is the UTC date the run started, as 2006/01/02
+	Date string
+	// Hostname is the name of the machine uploading
+	Hostname string
+}
+
+// keyTemplate renders -key per file when it holds template actions
+type keyTemplate struct {
+	tmpl     *template.Template
+	date     string
+	hostname string
+}
+
+func isKeyTemplate(key string) bool {
+	return strings.Contains(key, "{{")
+}
+
+// parseKeyTemplate parses text, using one date for every file so files
+// uploaded either side of midnight stay together
+func parseKeyTemplate(text string, now time.Time) (*keyTemplate, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid -key template: %v", err)
+	}
+
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname for -key template: %v", err)
+	}
+
+	return &keyTemplate{tmpl: tmpl, date: now.UTC().Format("2006/01/02"), hostname: hostname}, nil
+}
+
+// render returns the key for the file at filePath, whose path below the
+// uploaded directory is relPath, or empty outside a directory upload
+func (t *keyTemplate) render(filePath string, relPath string) (string, error) {
+	data := keyData{Date: t.date, Hostname: t.hostname}
+
+	if filePath != stitch.StdinPath {
+		data.Filename = filepath.Base(filePath)
+		data.Ext = filepath.Ext(filePath)
+	}
+
+	data.Path = relPath
+	if relPath == "" {
+		data.Path = data.Filename
+	}
+
+	var key strings.Builder
+
+	if err := t.tmpl.Execute(&key, data); err != nil {
+		return "", fmt.Errorf("invalid -key template: %v", err)
+	}
+
+	if key.Len() == 0 {
+		return "", fmt.Errorf("-key template gives an empty key for %s", filePath)
+	}
+
+	return key.String(), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+type jsonPart struct {
+	PartNumber   int32     `json:"partNumber"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type jsonParts struct {
+	Bucket     string     `json:"bucket"`
+	Key        string     `json:"key"`
+	UploadId   string     `json:"uploadId"`
+	Parts      []jsonPart `json:"parts"`
+	TotalBytes int64      `json:"totalBytes"`
+}
+
+// listUploadParts prints the parts stored for an upload, to see how far it
+// got and whether it can be resumed
+func listUploadParts(ctx context.Context, uploader *stitch.Uploader, bucket string, key string, uploadId string) error {
+	parts, err := uploader.ListParts(ctx, bucket, key, uploadId)
+
+	if err != nil {
+		return failure(bucket, key, err)
+	}
+
+	listing := jsonParts{Bucket: bucket, Key: key, UploadId: uploadId, Parts: make([]jsonPart, 0, len(parts))}
+
+	for _, part := range parts {
+		listing.Parts = append(listing.Parts, jsonPart{
+			PartNumber:   aws.ToInt32(part.PartNumber),
+			Size:         aws.ToInt64(part.Size),
+			ETag:         aws.ToString(part.ETag),
+			LastModified: aws.ToTime(part.LastModified),
+		})
+		listing.TotalBytes += aws.ToInt64(part.Size)
+	}
+
+	if jsonOutput {
+		return writeJSON(listing)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PART\tSIZE\tETAG\tLAST MODIFIED")
+
+	for _, part := range listing.Parts {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", part.PartNumber, part.Size, part.ETag, part.LastModified.Format(time.RFC3339))
+	}
+
+	w.Flush()
+
+	fmt.Fprintf(stdout, "Total: %d bytes in %d parts of upload %s\n", listing.TotalBytes, len(listing.Parts), uploadId)
+
+	// A resume has to split the file the same way, so the first part shows
+	// the chunk size it needs
+	if len(listing.Parts) > 1 && listing.Parts[0].PartNumber == 1 {
+		fmt.Fprintf(stdout, "Resume with -uploadId %s -chunkSize %d\n", uploadId, listing.Parts[0].Size)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// newLogger builds the stderr logger for -logLevel and -logFormat
+func newLogger(level string, format string) (*slog.Logger, error) {
+	var minimum slog.Level
+
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("-logLevel must be debug, info, warn, or error")
+	}
+
+	options := &slog.HandlerOptions{Level: minimum}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("-logFormat must be text or json")
+	}
+}
+
+// setOutput sets up the output of the run for -output, -quiet and -verbose,
+// returning the logger for -logLevel and -logFormat it also makes the default
+func setOutput(format string, quiet bool, verbose bool, level string, logFormat string) (*slog.Logger, error) {
+	switch format {
+	case "text":
+	case "json":
+		jsonOutput = true
+	default:
+		return nil, usagef("-output must be text or json")
+	}
+
+	if quiet && verbose {
+		return nil, usagef("-quiet and -verbose can't be used together")
+	}
+
+	if quiet || verbose {
+		if flagProvided("logLevel") {
+			return nil, usagef("-quiet and -verbose set the log level, so -logLevel can't be given")
+		}
+
+		level = "debug"
+		if quiet {
+			level = "error"
+			stdout, stderr = io.Discard, io.Discard
+		}
+	}
+
+	logger, err := newLogger(level, logFormat)
+
+	if err != nil {
+		return nil, usagef("%v", err)
+	}
+
+	slog.SetDefault(logger)
+
+	return logger, nil
+}
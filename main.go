@@ -1,168 +1,784 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
-	"sort"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/awarrington0895/stitch/stitch"
 )
 
-const defaultChunkSize = 15 * 1024 * 1024
-const minimumChunkSize = 5 * 1024 * 1024
+const defaultOverallTimeout = 24 * time.Hour
+
+func main() {
+	if err := run(); err != nil {
+		var usage usageError
+		if errors.As(err, &usage) {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			slog.Error(err.Error())
+		}
 
-type UploadConfiguration struct {
-	bucket    string
-	key       string
-	filePath  string
-	chunkSize int64
+		os.Exit(exitCode(err))
+	}
 }
 
-func main() {
+func run() error {
+	started := time.Now()
+
 	bucket := flag.String("bucket", "", "S3 bucket name")
-	key := flag.String("key", "", "S3 object key")
-	filePath := flag.String("file", "", "Path to the local file")
-	chunkSize := flag.Int64("chunkSize", defaultChunkSize, "Size of each chunk in bytes")
+	key := flag.String("key", "", "S3 object key, or the key prefix when -file is a directory. May be a template such as logs/{{.Date}}/{{.Hostname}}{{.Ext}} using .Filename, .Ext, .Path, .Date, and .Hostname, rendered per file")
+	rawKey := flag.Bool("rawKey", false, "Use keys exactly as given, without stripping leading slashes or collapsing repeated ones")
+	keyPrefix := flag.String("keyPrefix", "", "Key prefix for files matched by a glob, found in a directory, or listed without a key by -inputList")
+	filePath := flag.String("file", "", "Path to the local file or directory, a glob such as '/var/log/*.log', or - to read from stdin")
+	inputList := flag.String("inputList", "", "File listing the paths to upload one per line, each optionally followed by a tab and its key, or - to read the list from stdin. Blank lines and lines starting with # are skipped")
+	streamSize := byteSize("size", 0, "With -file -, the exact length of standard input, to plan its parts and show progress; a stream of any other length fails the upload")
+	chunkSize := byteSize("chunkSize", stitch.DefaultChunkSize, "Size of each chunk, in bytes or with a unit such as 15MB or 16MiB")
+	concurrency := flag.Int("concurrency", stitch.DefaultConcurrency, "Number of parts to upload in parallel")
+	parallelFiles := flag.Int("parallelFiles", 1, "Number of files to upload in parallel when uploading a directory, glob or input list")
+	maxRetries := flag.Int("maxRetries", stitch.DefaultMaxRetries, "Number of times to retry a failed part upload")
+	retryBaseDelay := flag.Duration("retryBaseDelay", stitch.DefaultRetryBaseDelay, "Initial delay between part upload retries")
+	var destFlags listFlag
+	flag.Var(&destFlags, "dest", "Destination as bucket:key, may be repeated to upload one read of -file to several objects at once in place of -bucket and -key")
+	bestEffort := flag.Bool("bestEffort", false, "With -dest, keep uploading to the other destinations when one fails instead of aborting them all")
+	autoRegion := flag.Bool("autoRegion", false, "Switch to the bucket's region when it differs from -region or the configured one, instead of failing")
+	sdkRetryMode := flag.String("sdkRetryMode", "", "AWS SDK retry mode, standard or adaptive to also slow down when S3 throttles; defaults to AWS_RETRY_MODE or standard. SDK retries happen within each of the -maxRetries part attempts")
+	sdkMaxAttempts := flag.Int("sdkMaxAttempts", 0, "Attempts the AWS SDK makes per request before stitch sees a failure; defaults to AWS_MAX_ATTEMPTS or 3")
+	maxRate := byteRate("maxRate", 0, "Cap on total upload throughput, e.g. 10MB/s (unlimited when 0)")
+	readAhead := flag.Int("readAhead", 0, "Number of parts to read ahead while every worker is uploading, to overlap slow disk reads with the network; each holds a chunk buffer")
+	var partSizes sizeListFlag
+	flag.Var(&partSizes, "partSizes", "Comma separated sizes of every part in order, in place of -chunkSize, for benchmarks and reproducing edge cases")
+	multipartThreshold := byteSize("multipartThreshold", stitch.DefaultMultipartThreshold, "Files smaller than this are uploaded with a single PutObject instead of a multipart upload, or 0 to use multipart for any file that isn't empty")
+	maxMemory := byteSize("maxMemory", 0, "Cap on memory used for chunk buffers, e.g. 1GB; concurrency is reduced to fit (unlimited when 0)")
+	quiet := flag.Bool("quiet", false, "Show errors only, without the progress bar, summaries, or logs below error")
+	verbose := flag.Bool("verbose", false, "Log every part with its offset and timing, and each retry decision")
+	logLevel := flag.String("logLevel", "info", "Minimum log level, debug, info, warn, or error")
+	logFormat := flag.String("logFormat", "text", "Log format, text or json")
+	checksumAlgorithm := flag.String("checksumAlgorithm", "", "Per-part checksum S3 should validate (CRC32, CRC32C, SHA1, or SHA256)")
+	checksumMode := flag.String("checksumMode", "precomputed", "How -checksumAlgorithm checksums are sent: precomputed, or trailer to compute them while sending each part")
+	useContentMD5 := flag.Bool("contentMD5", false, "Send each part's MD5 so S3 rejects corrupted parts; can't be combined with -checksumAlgorithm, which is cheaper and keeps the checksum on the object")
+	storageClass := flag.String("storageClass", "", "S3 storage class for the object, e.g. STANDARD_IA, GLACIER, or DEEP_ARCHIVE")
+	acl := flag.String("acl", "", "Canned ACL for the object, e.g. bucket-owner-full-control")
+	contentType := flag.String("contentType", "", "Content-Type of the object, detected from the file when omitted")
+	cacheControl := flag.String("cacheControl", "", "Cache-Control header of the object, such as max-age=3600")
+	contentDisposition := flag.String("contentDisposition", "", "Content-Disposition header of the object, such as attachment; filename=report.pdf")
+	useGzip := flag.Bool("gzip", false, "Compress with gzip while uploading, setting Content-Encoding gzip and adding -gzipSuffix to the key")
+	gzipSuffix := flag.String("gzipSuffix", ".gz", "Suffix added to the key of each file compressed with -gzip, or empty to keep the key as given")
+	contentEncoding := flag.String("contentEncoding", "", "Content-Encoding header of the object, such as gzip for a file that is already compressed")
+	expires := flag.String("expires", "", "Expires header of the object, as an RFC 3339 time or a duration from now such as 72h. Only a bucket lifecycle rule actually deletes objects")
+	metadata := keyValueFlag{}
+	flag.Var(metadata, "meta", "Object metadata as key=value, may be repeated")
+	tags := keyValueFlag{}
+	flag.Var(tags, "tag", "Object tag as key=value, may be repeated up to 10 times")
+	sse := flag.String("sse", "", "Server-side encryption for the object (AES256 or aws:kms)")
+	kmsKeyId := flag.String("kmsKeyId", "", "KMS key for aws:kms encryption, defaults to the account's S3 key")
+	encryptionContext := keyValueFlag{}
+	flag.Var(encryptionContext, "kmsEncryptionContext", "KMS encryption context for aws:kms encryption as key=value, may be repeated")
+	requestPayer := flag.Bool("requestPayer", false, "Accept the request charges of a Requester Pays bucket")
+	expectedBucketOwner := flag.String("expectedBucketOwner", "", "Account id the bucket must belong to; S3 denies every request of the upload when another account owns it")
+	objectLockMode := flag.String("objectLockMode", "", "Object Lock retention mode, GOVERNANCE or COMPLIANCE; requires -objectLockRetainUntil")
+	objectLockRetainUntil := flag.String("objectLockRetainUntil", "", "RFC 3339 time the Object Lock retention ends, e.g. 2030-01-01T00:00:00Z")
+	objectLockLegalHold := flag.String("objectLockLegalHold", "", "Object Lock legal hold, on or off")
+	endpoint := flag.String("endpoint", "", "Custom S3 endpoint URL for S3-compatible services such as MinIO or R2")
+	pathStyle := flag.Bool("pathStyle", false, "Address the bucket in the URL path instead of the hostname")
+	useFIPS := flag.Bool("useFIPS", false, "Use the S3 FIPS endpoint for the region")
+	accelerate := flag.Bool("accelerate", false, "Upload through the bucket's S3 Transfer Acceleration endpoint, which must be enabled on the bucket")
+	useDualstack := flag.Bool("useDualstack", false, "Use the S3 dualstack endpoint, reachable over IPv6 as well as IPv4")
+	accessKeyId := flag.String("accessKeyId", "", "Static AWS access key id, bypassing the default credential chain (or set "+accessKeyIdEnv+")")
+	secretAccessKey := flag.String("secretAccessKey", "", "Static AWS secret access key for -accessKeyId (or set "+secretAccessKeyEnv+")")
+	sessionToken := flag.String("sessionToken", "", "Session token for temporary -accessKeyId credentials (or set "+sessionTokenEnv+")")
+	roleArn := flag.String("roleArn", "", "IAM role to assume for the upload, using the loaded credentials")
+	roleSessionName := flag.String("roleSessionName", "", "Session name for -roleArn, defaults to stitch-<unix time>")
+	externalId := flag.String("externalId", "", "External ID required by the trust policy of -roleArn")
+	region := flag.String("region", "", "AWS region, overrides AWS_REGION and the shared config")
+	profile := flag.String("profile", "", "Shared config profile, overrides AWS_PROFILE")
+	credentialsFile := flag.String("credentialsFile", "", "Shared credentials file to use instead of ~/.aws/credentials, overrides AWS_SHARED_CREDENTIALS_FILE")
+	configFile := flag.String("configFile", "", "Shared config file to use instead of ~/.aws/config, overrides AWS_CONFIG_FILE")
+	auto := flag.Bool("auto", false, "Choose the chunk size from the file size, unless -chunkSize is given")
+	tune := flag.Bool("tune", false, "Choose the chunk size and concurrency from the file size and CPU count, unless -chunkSize or -concurrency is given; a directory, or a stream without -size, only has its chunk size chosen, like -auto")
+	autoChunk := flag.Bool("autoChunk", false, "Raise -chunkSize for any file that would need more parts than -maxParts allows, rather than failing it")
+	verify := flag.Bool("verify", false, "Check the completed object's size and ETag and compare its SHA-256 with the local file")
+	dryRun := flag.Bool("dryRun", false, "Print the upload plan, or with -cleanup the uploads it would abort, without changing anything in S3")
+	partTimeout := flag.Duration("partTimeout", stitch.DefaultPartTimeout, "Timeout for each individual S3 request; timed out parts are retried")
+	overallTimeout := flag.Duration("overallTimeout", defaultOverallTimeout, "Timeout for the entire run")
+	stateFile := flag.String("stateFile", "", "JSON file recording uploaded files, so files with an unchanged size and mtime are skipped")
+	followSymlinks := flag.Bool("followSymlinks", false, "Upload the files and directories that symlinks in a directory point to, instead of skipping them")
+	progressFile := flag.String("progressFile", "", "JSON file kept up to date with the upload id and stored parts during the upload, to resume or abort it after an interruption; removed once the upload completes")
+	failureReport := flag.String("failureReport", "", "JSON file listing every file of a directory, glob or input list that failed to upload")
+	force := flag.Bool("force", false, "Upload every file even if -stateFile records it as unchanged")
+	ifMatch := flag.String("ifMatch", "", "Only complete the upload if the object still has this ETag")
+	ifNoneMatch := flag.Bool("ifNoneMatch", false, "Only complete the upload if the object doesn't exist yet")
+	ifNotExists := flag.Bool("ifNotExists", false, "Skip the upload when the object already exists with the same size")
+	outputFormat := flag.String("output", "text", "Output format, text or json. The JSON of a directory, glob, input list or -dest is an array of results ending with the totals of the run")
+	configPath := flag.String("config", "", "YAML file of flag defaults, ~/.stitch.yaml when it exists")
+	timing := flag.Bool("timing", false, "Log how long each part took to read and upload, and print a summary of part times at the end")
+	useOtel := flag.Bool("otel", false, "Export an OpenTelemetry trace of each upload over OTLP/HTTP, configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	metricsAddr := flag.String("metricsAddr", "", "Address such as :9090 to serve Prometheus metrics on at /metrics during the upload")
+	presignURL := flag.String("presignURL", "", "Upload through presigned URLs from this service instead of AWS credentials (bearer token from "+presignTokenEnv+")")
+	listParts := flag.Bool("listParts", false, "List the parts stored so far for the -uploadId upload of -bucket and -key instead of uploading")
+	computeEtag := flag.Bool("computeEtag", false, "Print the ETag an upload of -file at -chunkSize would get instead of uploading, to compare with the object's ETag in S3; a file below -multipartThreshold gets the plain MD5 of a PutObject")
+	cleanup := flag.Bool("cleanup", false, "Abort multipart uploads in -bucket older than -olderThan instead of uploading, limited to -keyPrefix if given")
+	olderThan := flag.Duration("olderThan", 24*time.Hour, "Minimum age of the uploads -cleanup aborts")
+	resumeUploadId := flag.String("uploadId", "", "Resume an existing multipart upload instead of starting a new one")
+	noComplete := flag.Bool("noComplete", false, "Upload every part but leave the multipart upload open for another party to complete, printing its upload id and parts as JSON instead of completing it. The upload is kept on failure")
+	completionFile := flag.String("completionFile", "", "With -noComplete, write the upload id and parts to this file instead of standard output")
+	keepOnFailure := flag.Bool("keepOnFailure", false, "Keep the multipart upload when it fails so it can be resumed with -uploadId, instead of aborting it; its parts are billed as stored until it is resumed or aborted")
+	requireAligned := flag.Bool("requireAligned", false, "Fail a resume whose stored parts, or -progressFile chunk size, don't line up with -chunkSize instead of uploading mismatched parts again")
+	resumeOrRestart := flag.Bool("resumeOrRestart", false, "Start a new upload when the -uploadId one no longer exists instead of failing")
+	maxPartsFlag := flag.Int64("maxParts", stitch.MaxParts, "Fail before uploading if a file would need more parts than this")
+	startPart := flag.Int("startPart", 1, "Number of the first part, for writing a range of parts of an upload shared with other writers")
+	flag.Usage = usageWithExitCodes
 	flag.Parse()
 
-	if *bucket == "" || *key == "" || *filePath == "" {
+	logger, err := setOutput(*outputFormat, *quiet, *verbose, *logLevel, *logFormat)
+
+	if err != nil {
+		return err
+	}
+
+	// An explicit -chunkSize takes precedence over -auto, whether it comes
+	// from the command line or the config file
+	if err := applyConfigFile(*configPath); err != nil {
+		return usagef("%v", err)
+	}
+
+	*accessKeyId = valueOrEnv(*accessKeyId, accessKeyIdEnv)
+	*secretAccessKey = valueOrEnv(*secretAccessKey, secretAccessKeyEnv)
+	*sessionToken = valueOrEnv(*sessionToken, sessionTokenEnv)
+
+	if *endpoint != "" && (*useFIPS || *useDualstack) {
+		return usagef("-useFIPS and -useDualstack pick an AWS endpoint, so they can't be used with -endpoint")
+	}
+
+	if *accelerate && (*endpoint != "" || *pathStyle || *useFIPS) {
+		return usagef("-accelerate needs the bucket's own accelerated endpoint, so it can't be used with -endpoint, -pathStyle, or -useFIPS")
+	}
+
+	if (*accessKeyId == "") != (*secretAccessKey == "") {
+		return usagef("-accessKeyId and -secretAccessKey must be given together")
+	}
+
+	if *sessionToken != "" && *accessKeyId == "" {
+		return usagef("-sessionToken requires -accessKeyId and -secretAccessKey")
+	}
+
+	if *roleArn == "" && (*roleSessionName != "" || *externalId != "") {
+		return usagef("-roleSessionName and -externalId require -roleArn")
+	}
+
+	var retryMode aws.RetryMode
+	if *sdkRetryMode != "" {
+		parsed, err := aws.ParseRetryMode(*sdkRetryMode)
+
+		if err != nil {
+			return usagef("-sdkRetryMode must be standard or adaptive, got %q", *sdkRetryMode)
+		}
+
+		retryMode = parsed
+	}
+
+	if *sdkMaxAttempts < 0 {
+		return usagef("-sdkMaxAttempts must not be negative")
+	}
+
+	if *concurrency < 1 {
+		return usagef("-concurrency must be at least 1")
+	}
+
+	if *readAhead < 0 {
+		return usagef("-readAhead must not be negative")
+	}
+
+	if *parallelFiles < 1 {
+		return usagef("-parallelFiles must be at least 1")
+	}
+
+	if *maxRetries < 0 {
+		return usagef("-maxRetries must not be negative")
+	}
+
+	// The SDK quietly skips shared files that don't exist, which would leave
+	// a mistyped path to fall back on the default credentials
+	for name, path := range map[string]string{"credentialsFile": *credentialsFile, "configFile": *configFile} {
+		if path == "" {
+			continue
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			return usagef("-%s: %v", name, err)
+		}
+	}
+
+	clientOpts := clientOptions{
+		endpoint:  *endpoint,
+		pathStyle: *pathStyle,
+		region:    *region,
+		profile:   *profile,
+
+		useFIPS:      *useFIPS,
+		useDualstack: *useDualstack,
+		accelerate:   *accelerate,
+
+		credentialsFile: *credentialsFile,
+		configFile:      *configFile,
+
+		accessKeyId:     *accessKeyId,
+		secretAccessKey: *secretAccessKey,
+		sessionToken:    *sessionToken,
+
+		roleArn:         *roleArn,
+		roleSessionName: *roleSessionName,
+		externalId:      *externalId,
+
+		retryMode:   retryMode,
+		maxAttempts: *sdkMaxAttempts,
+	}
+
+	uploaderOpts := uploaderOptions{
+		concurrency:    *concurrency,
+		parallelFiles:  *parallelFiles,
+		readAhead:      *readAhead,
+		maxRetries:     *maxRetries,
+		retryBaseDelay: *retryBaseDelay,
+		partTimeout:    *partTimeout,
+		maxRate:        *maxRate,
+		maxMemory:      *maxMemory,
+		logger:         logger,
+	}
+
+	if *presignURL != "" {
+		for _, name := range presignUnsupported {
+			if flagProvided(name) {
+				return usagef("-%s can't be used with -presignURL", name)
+			}
+		}
+	}
+
+	if *cleanup {
+		if *bucket == "" {
+			return usagef("-cleanup requires -bucket")
+		}
+
+		if *olderThan <= 0 {
+			return usagef("-olderThan must be positive")
+		}
+
+		ctx, cancel := runContext(*overallTimeout)
+		defer cancel()
+
+		client, refresh, err := initializeClient(ctx, clientOpts)
+
+		if err != nil {
+			return err
+		}
+
+		return cleanupUploads(ctx, uploaderOpts.newUploader(client, refresh), *bucket, *keyPrefix, *olderThan, *dryRun)
+	}
+
+	if *listParts {
+		if *bucket == "" || *key == "" || *resumeUploadId == "" {
+			return usagef("-listParts requires -bucket, -key, and -uploadId")
+		}
+
+		if !*rawKey {
+			*key = normalizedKey(*key)
+		}
+
+		ctx, cancel := runContext(*overallTimeout)
+		defer cancel()
+
+		client, refresh, err := initializeClient(ctx, clientOpts)
+
+		if err != nil {
+			return failure(*bucket, *key, err)
+		}
+
+		return listUploadParts(ctx, uploaderOpts.newUploader(client, refresh), *bucket, *key, *resumeUploadId)
+	}
+
+	if *computeEtag {
+		if *filePath == "" || *filePath == stitch.StdinPath || stitch.HasGlobMeta(*filePath) {
+			return usagef("-computeEtag requires -file naming a single file")
+		}
+
+		if *chunkSize < stitch.MinimumChunkSize || *chunkSize > stitch.MaximumChunkSize {
+			return usagef("-chunkSize must be between %d and %d", stitch.MinimumChunkSize, stitch.MaximumChunkSize)
+		}
+
+		// A file below the threshold is sent with a PutObject, and gets the
+		// plain MD5 as its ETag
+		return printComputedETag(uploaderOpts.newUploader(nil, nil), stitch.UploadConfiguration{FilePath: *filePath, ChunkSize: *chunkSize, MultipartThreshold: *multipartThreshold})
+	}
+
+	adaptive := (*auto || *tune) && !flagProvided("chunkSize")
+
+	if *inputList != "" && *filePath != "" {
+		return usagef("-inputList gives the files to upload, so -file can't be given")
+	}
+
+	// The files of a glob or input list are all known before uploading
+	isListed := stitch.HasGlobMeta(*filePath) || *inputList != ""
+
+	// The first destination stands in for -bucket and -key, which is the
+	// bucket the client is set up for
+	var dests []stitch.Destination
+	if len(destFlags) > 0 {
+		if *bucket != "" || *key != "" {
+			return usagef("-dest replaces -bucket and -key, give every destination with -dest")
+		}
+
+		parsed, err := parseDestinations(destFlags, *rawKey)
+
+		if err != nil {
+			return err
+		}
+
+		dests = parsed
+		*bucket, *key = dests[0].Bucket, dests[0].Key
+	}
+
+	if *bestEffort && len(dests) == 0 {
+		return usagef("-bestEffort requires -dest")
+	}
+
+	var keyTmpl *keyTemplate
+	if isKeyTemplate(*key) {
+		if *keyPrefix != "" {
+			return usagef("-keyPrefix can't be used with a -key template, put the prefix in the template")
+		}
+
+		parsed, err := parseKeyTemplate(*key, time.Now())
+
+		if err != nil {
+			return usagef("%v", err)
+		}
+
+		keyTmpl = parsed
+	}
+
+	if *startPart < 1 || *startPart > stitch.MaxParts {
+		return usagef("-startPart must be between 1 and %d", stitch.MaxParts)
+	}
+
+	if *maxPartsFlag < 1 || *maxPartsFlag > stitch.MaxParts {
+		return usagef("-maxParts must be between 1 and %d", stitch.MaxParts)
+	}
+
+	// Parts before the start are left to other writers
+	maxParts := min(*maxPartsFlag, int64(stitch.MaxParts-*startPart+1))
+
+	if *bucket == "" || (*filePath == "" && *inputList == "") || (*key == "" && !isListed && *keyPrefix == "") {
 		flag.Usage()
-		fmt.Println("bucket, key, and file must all be provided")
-		os.Exit(1)
+		return usagef("bucket, key, and file must all be provided")
 	}
 
-	if *chunkSize < minimumChunkSize {
-		fmt.Println("-chunkSize must be greater than: ", minimumChunkSize)
-		os.Exit(1)
+	if *chunkSize < stitch.MinimumChunkSize {
+		return usagef("-chunkSize must be at least %d", stitch.MinimumChunkSize)
 	}
 
-	cfg := UploadConfiguration{
-		bucket:    *bucket,
-		key:       *key,
-		filePath:  *filePath,
-		chunkSize: *chunkSize,
+	if *chunkSize > stitch.MaximumChunkSize {
+		return usagef("-chunkSize must be at most %d, the largest part S3 accepts", stitch.MaximumChunkSize)
 	}
 
-	ctx := context.Background()
+	isDirectory := false
+	fileSize := int64(-1)
+
+	if *filePath != stitch.StdinPath && !isListed {
+		info, err := os.Stat(*filePath)
+
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %v", err)
+		}
+
+		isDirectory = info.IsDir()
+		fileSize = info.Size()
+
+		if !isDirectory && *key == "" {
+			flag.Usage()
+			return usagef("bucket, key, and file must all be provided")
+		}
 
-	client, err := initializeClient(ctx)
-	if err != nil {
-		log.Fatalf("%v", err)
 	}
 
-	// 1. Initiate multipart upload
-	createResp, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-		Bucket: &cfg.bucket,
-		Key:    &cfg.key,
-	})
+	if flagProvided("size") {
+		if *filePath != stitch.StdinPath {
+			return usagef("-size gives the length of standard input, so it needs -file -")
+		}
 
-	if err != nil {
-		log.Fatalf("failed to create multipart upload: %v", err)
+		if len(dests) > 0 {
+			return usagef("-size can't be used with -dest")
+		}
+
+		fileSize = *streamSize
 	}
 
-	uploadId := *createResp.UploadId
-	fmt.Println("Upload ID: ", uploadId)
+	if fileSize >= 0 && !isDirectory {
+		if *tune {
+			tuned := tuneUpload(fileSize, maxParts, runtime.NumCPU())
 
-	completedParts, err := uploadParts(cfg, client, ctx, uploadId)
+			if !flagProvided("chunkSize") {
+				*chunkSize = tuned.chunkSize
+				adaptive = false
+			}
 
-	if err != nil {
-		// Abort on failure
-		_, _ = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
-			Bucket:   &cfg.bucket,
-			Key:      &cfg.key,
-			UploadId: &uploadId,
-		})
-		log.Fatalf("failed to upload parts: %v", err)
-	}
-
-	// 3. Complete the upload
-	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   bucket,
-		Key:      key,
-		UploadId: &uploadId,
-		MultipartUpload: &types.CompletedMultipartUpload{
-			Parts: completedParts,
-		},
-	})
+			if !flagProvided("concurrency") {
+				uploaderOpts.concurrency = tuned.concurrency
+			}
 
-	if err != nil {
-		log.Fatalf("failed to complete multipart upload: %v", err)
+			slog.Info("Tuned upload", "size", fileSize, "chunkSize", *chunkSize, "concurrency", uploaderOpts.concurrency,
+				"parts", stitch.PartCount(fileSize, *chunkSize), "cpus", runtime.NumCPU())
+		}
+
+		if parts := stitch.PartCount(fileSize, *chunkSize); parts > maxParts && !adaptive && len(partSizes) == 0 {
+			suggested := stitch.ChunkSizeForParts(fileSize, maxParts)
+
+			if !*autoChunk {
+				return usagef("%s needs %d parts at -chunkSize %d but at most %d are allowed, use -chunkSize %d or -autoChunk",
+					*filePath, parts, *chunkSize, maxParts, suggested)
+			}
+
+			slog.Info("Raising chunk size to stay within the part limit", "chunkSize", *chunkSize, "raisedTo", suggested, "maxParts", maxParts)
+			*chunkSize = suggested
+		}
 	}
 
-	fmt.Println("Upload completed successfully!")
-}
+	if *useGzip {
+		if *contentEncoding != "" {
+			return usagef("-gzip sets the content encoding, so -contentEncoding can't be given")
+		}
+
+		if *resumeUploadId != "" || *ifNotExists {
+			return usagef("-gzip uploads can't be resumed or skipped when present, so -uploadId and -ifNotExists can't be used")
+		}
+	}
+
+	if keyTmpl != nil && !isListed && !isDirectory {
+		rendered, err := keyTmpl.render(*filePath, "")
+
+		if err != nil {
+			return usagef("%v", err)
+		}
+
+		*key = rendered
+	}
 
-func uploadParts(cfg UploadConfiguration, client *s3.Client, ctx context.Context, uploadId string) ([]types.CompletedPart, error) {
-	f, err := os.Open(cfg.filePath)
+	if *useGzip && !isListed && !isDirectory {
+		*key += *gzipSuffix
+	}
+
+	if !*rawKey && !isListed && !isDirectory && len(dests) == 0 {
+		*key = normalizedKey(*key)
+	}
+
+	// These only apply to the upload of a single file
+	if isListed || isDirectory {
+		switch {
+		case *resumeUploadId != "":
+			return usagef("-uploadId can only be used when uploading a single file")
+		case *noComplete:
+			return usagef("-noComplete leaves a single file's upload open, not those of a directory, glob or input list")
+		case *progressFile != "":
+			return usagef("-progressFile can't be used with a directory, glob or input list")
+		case len(partSizes) > 0:
+			return usagef("-partSizes gives the parts of a single file, not of a directory, glob or input list")
+		case len(dests) > 0:
+			return usagef("-dest uploads a single file, not a directory, glob or input list")
+		case *ifMatch != "":
+			// An ETag belongs to a single object
+			return usagef("-ifMatch can't be used with a directory, glob or input list")
+		}
+	} else if *failureReport != "" {
+		return usagef("-failureReport requires a directory, glob or input list")
+	}
+
+	if *keepOnFailure && (*filePath == stitch.StdinPath || *useGzip) {
+		return usagef("-keepOnFailure keeps uploads to resume, but standard input and -gzip uploads can't be resumed")
+	}
+
+	if *noComplete && (*verify || *stateFile != "") {
+		return usagef("-noComplete leaves no object to verify or record, so -verify and -stateFile can't be used")
+	}
+
+	if *completionFile != "" && !*noComplete {
+		return usagef("-completionFile requires -noComplete")
+	}
+
+	if *requireAligned && *resumeUploadId == "" {
+		return usagef("-requireAligned checks a resume, so it needs an -uploadId")
+	}
+
+	if *resumeOrRestart && *resumeUploadId == "" {
+		return usagef("-resumeOrRestart needs an -uploadId to resume")
+	}
+
+	algorithm, mode, err := parseChecksumFlags(*checksumAlgorithm, *checksumMode, *useContentMD5)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		return err
 	}
 
-	defer f.Close()
+	if *ifMatch != "" && *ifNoneMatch {
+		return usagef("-ifMatch and -ifNoneMatch can't be used together")
+	}
 
-	partNum := int32(1)
+	// Each destination starts an upload of its own from the one read
+	if len(dests) > 0 {
+		for _, name := range []string{"uploadId", "ifNotExists", "stateFile", "progressFile", "startPart", "ifMatch", "partSizes", "noComplete"} {
+			if flagProvided(name) {
+				return usagef("-%s can't be used with -dest", name)
+			}
+		}
+	}
 
-	buffer := make([]byte, cfg.chunkSize)
+	var noneMatch string
+	if *ifNoneMatch {
+		noneMatch = "*"
+	}
+
+	cfg := stitch.UploadConfiguration{
+		Bucket:    *bucket,
+		Key:       *key,
+		FilePath:  *filePath,
+		ChunkSize: *chunkSize,
+		UploadId:  *resumeUploadId,
+
+		RestartMissingUpload: *resumeOrRestart,
+		KeepOnFailure:        *keepOnFailure,
+		NoComplete:           *noComplete,
+		RequireAligned:       *requireAligned,
+		StartPart:            int32(*startPart),
+		MultipartThreshold:   *multipartThreshold,
+		PartSizes:            partSizes,
+		MaxParts:             *maxPartsFlag,
+		Verify:               *verify,
+
+		AdaptiveChunkSize:   adaptive,
+		AutoChunkSize:       *autoChunk,
+		SkipExisting:        *ifNotExists,
+		RequestPayer:        *requestPayer,
+		ExpectedBucketOwner: *expectedBucketOwner,
+		IfMatch:             *ifMatch,
+		IfNoneMatch:         noneMatch,
+
+		ChecksumAlgorithm: algorithm,
+		ChecksumMode:      mode,
+		ContentMD5:        *useContentMD5,
+		ContentType:       *contentType,
+		Metadata:          metadata,
+		Tags:              tags,
+
+		CacheControl:       *cacheControl,
+		ContentDisposition: *contentDisposition,
+		ContentEncoding:    *contentEncoding,
+		Gzip:               *useGzip,
+	}
+
+	objectOpts := objectOptions{
+		storageClass:      *storageClass,
+		acl:               *acl,
+		sse:               *sse,
+		kmsKeyId:          *kmsKeyId,
+		encryptionContext: encryptionContext,
+		expires:           *expires,
+
+		lockMode:        *objectLockMode,
+		lockRetainUntil: *objectLockRetainUntil,
+		legalHold:       *objectLockLegalHold,
+	}
+
+	if err := objectOpts.apply(&cfg); err != nil {
+		return err
+	}
 
-	var completedParts []types.CompletedPart
+	// A glob or input list is read up front, while a directory is walked as
+	// its files upload
+	var batch *batchInput
+	if isListed || isDirectory {
+		// Directories fall back to -key as the prefix, unless it's a template
+		// rendered for each file
+		prefix := *keyPrefix
+		if prefix == "" && isDirectory && keyTmpl == nil {
+			prefix = *key
+		}
+
+		keys := &fileKeys{tmpl: keyTmpl, normalize: !*rawKey}
+		if *useGzip {
+			keys.suffix = *gzipSuffix
+		}
 
-	for {
-		n, err := f.Read(buffer)
+		batch = &batchInput{bucket: *bucket, prefix: prefix, keys: keys, followSymlinks: *followSymlinks, force: *force}
 
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read file: %v", err)
+		if isDirectory {
+			batch.dir = *filePath
+		} else if err := batch.list(*filePath, *inputList); err != nil {
+			return err
 		}
+	}
 
-		if n == 0 {
-			break
+	var state *uploadState
+	if *stateFile != "" {
+		if *filePath == stitch.StdinPath {
+			return usagef("-stateFile can't be used when reading from stdin")
 		}
 
-		// 2. Upload each part
-		partResp, err := client.UploadPart(ctx, &s3.UploadPartInput{
-			Bucket:     &cfg.bucket,
-			Key:        &cfg.key,
-			PartNumber: aws.Int32(partNum),
-			UploadId:   &uploadId,
-			Body:       bytes.NewReader(buffer[:n]),
-		})
+		loaded, err := loadUploadState(*stateFile)
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload part %d: %v", partNum, err)
+			return failure(*bucket, *filePath, err)
 		}
 
-		fmt.Printf("Uploaded part %d, ETag: %s\n", partNum, *partResp.ETag)
+		state = loaded
 
-		pn := partNum
-		completedParts = append(completedParts, types.CompletedPart{
-			ETag:       partResp.ETag,
-			PartNumber: aws.Int32(pn),
-		})
+		if batch != nil {
+			if err := batch.leaveUnchanged(state); err != nil {
+				return failure(*bucket, *filePath, err)
+			}
+		} else if skipped, err := skipUnchanged(state, cfg, *force); skipped || err != nil {
+			return err
+		}
+	}
 
-		partNum++
+	if *progressFile != "" && cfg.UploadId != "" {
+		if err := checkProgressChunkSize(*progressFile, cfg.UploadId, cfg.EffectiveChunkSize(fileSize), cfg.RequireAligned); err != nil {
+			return failure(cfg.Bucket, cfg.Key, err)
+		}
 	}
 
-	sort.Slice(completedParts, func(i, j int) bool {
-		return *completedParts[i].PartNumber < *completedParts[j].PartNumber
-	})
+	if *dryRun {
+		planned := []stitch.FileUpload{{FilePath: cfg.FilePath, Key: cfg.Key}}
+		if batch != nil {
+			found, _, err := collectFiles(batch.found(context.Background(), state))
 
-	return completedParts, nil
-}
+			if err != nil {
+				return failure(cfg.Bucket, *filePath, err)
+			}
+
+			planned = found
+		}
+
+		// Planned with the memory limit the upload would have
+		if err := printPlan(uploaderOpts.newUploader(nil, nil), cfg, planned, batch != nil, fileSize); err != nil {
+			return failure(cfg.Bucket, cfg.Key, err)
+		}
+
+		return nil
+	}
 
-func initializeClient(ctx context.Context) (*s3.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+	ctx, cancel := runContext(*overallTimeout)
+	defer cancel()
+
+	client, refresh, err := uploadClient(ctx, clientOpts, *presignURL, *bucket, dests, *autoRegion)
 
 	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+		return failure(*bucket, *key, err)
 	}
 
-	return s3.NewFromConfig(cfg), nil
+	uploader := uploaderOpts.newUploader(client, refresh)
+
+	var metrics *uploadMetrics
+	if *metricsAddr != "" {
+		metrics = newUploadMetrics()
+
+		shutdown, err := serveMetrics(*metricsAddr, metrics)
+
+		if err != nil {
+			return failure(*bucket, *key, err)
+		}
+		defer shutdown()
+
+		uploader.Metrics = metrics
+	}
+
+	if *useOtel {
+		tracer, shutdown, err := startTracing(ctx)
+
+		if err != nil {
+			return failure(*bucket, *key, err)
+		}
+		defer shutdown()
+
+		uploader.Tracer = tracer
+	}
+
+	uploader.Timing = *timing || *verbose
+
+	uploader.Pause = &stitch.PauseGate{}
+	defer handlePauseSignals(uploader.Pause)()
+
+	// Bars from files uploading side by side would overwrite each other
+	if !*quiet && !jsonOutput && isTerminal(os.Stderr) && *parallelFiles == 1 {
+		uploader.Progress = os.Stderr
+	}
+
+	switch {
+	case len(dests) > 0:
+		return accessDeniedHint(cfg, uploadFanOut(ctx, uploader, cfg, dests, *bestEffort, metrics, started))
+	case batch != nil:
+		return accessDeniedHint(cfg, uploadBatch(ctx, uploader, cfg, batch.found(ctx, state), state, metrics, *failureReport, started))
+	default:
+		return uploadSingleFile(ctx, uploader, cfg, fileSize, state, *progressFile, *completionFile, metrics, started)
+	}
+}
+
+// uploaderOptions are the Uploader settings given by flags, for every mode
+// that talks to S3
+type uploaderOptions struct {
+	concurrency    int
+	parallelFiles  int
+	readAhead      int
+	maxRetries     int
+	retryBaseDelay time.Duration
+	partTimeout    time.Duration
+	maxRate        int64
+	maxMemory      int64
+	logger         *slog.Logger
+}
+
+// newUploader is an Uploader sending requests through client, or one that
+// only plans uploads when client is nil
+func (o uploaderOptions) newUploader(client stitch.S3MultipartAPI, refresh func(context.Context) error) *stitch.Uploader {
+	uploader := stitch.NewUploader(client)
+	uploader.Concurrency = o.concurrency
+	uploader.MaxRetries = o.maxRetries
+	uploader.RetryBaseDelay = o.retryBaseDelay
+	uploader.MaxRate = o.maxRate
+	uploader.PartTimeout = o.partTimeout
+	uploader.FileConcurrency = o.parallelFiles
+	// Each file side by side gets its own share of the memory limit
+	uploader.MaxMemory = o.maxMemory / int64(o.parallelFiles)
+	uploader.ReadAhead = o.readAhead
+	uploader.Logger = o.logger
+	uploader.RefreshCredentials = refresh
+
+	return uploader
+}
+
+// runContext cancels in-flight work on Ctrl-C or SIGTERM, so an upload can be
+// aborted cleanly, or once timeout has passed
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	// A second signal should kill the process rather than wait on the abort
+	context.AfterFunc(ctx, stop)
+
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
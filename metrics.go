@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsShutdownTimeout bounds how long a scrape in progress can hold up exit
+const metricsShutdownTimeout = 5 * time.Second
+
+// uploadMetrics are the Prometheus collectors behind -metricsAddr. A nil
+// *uploadMetrics records nothing.
+type uploadMetrics struct {
+	registry *prometheus.Registry
+
+	bytes          prometheus.Counter
+	parts          prometheus.Counter
+	partDuration   prometheus.Histogram
+	retries        prometheus.Counter
+	partFailures   prometheus.Counter
+	uploads        prometheus.Counter
+	uploadFailures prometheus.Counter
+}
+
+func newUploadMetrics() *uploadMetrics {
+	m := &uploadMetrics{
+		registry: prometheus.NewRegistry(),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_uploaded_bytes_total",
+			Help: "Bytes stored in S3 by completed part uploads.",
+		}),
+		parts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_parts_completed_total",
+			Help: "Parts uploaded successfully.",
+		}),
+		partDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "stitch_part_upload_duration_seconds",
+			Help:    "Time to upload a part, including retries.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_part_retries_total",
+			Help: "Part uploads retried after a transient failure.",
+		}),
+		partFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_part_failures_total",
+			Help: "Parts that failed after their last attempt.",
+		}),
+		uploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_uploads_completed_total",
+			Help: "Files uploaded successfully.",
+		}),
+		uploadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stitch_upload_failures_total",
+			Help: "Files that failed to upload.",
+		}),
+	}
+
+	m.registry.MustRegister(m.bytes, m.parts, m.partDuration, m.retries, m.partFailures, m.uploads, m.uploadFailures)
+
+	return m
+}
+
+func (m *uploadMetrics) PartUploaded(size int, duration time.Duration) {
+	m.bytes.Add(float64(size))
+	m.parts.Inc()
+	m.partDuration.Observe(duration.Seconds())
+}
+
+func (m *uploadMetrics) PartRetried() {
+	m.retries.Inc()
+}
+
+func (m *uploadMetrics) PartFailed() {
+	m.partFailures.Inc()
+}
+
+// uploadFinished counts a file's outcome
+func (m *uploadMetrics) uploadFinished(err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.uploadFailures.Inc()
+	} else {
+		m.uploads.Inc()
+	}
+}
+
+// serveMetrics exposes m on addr at /metrics until the returned shutdown is
+// called. The listener is opened before returning so a bad address fails the
+// run up front.
+func serveMetrics(addr string, m *uploadMetrics) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to start metrics server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+
+	slog.Info("Serving metrics", "addr", listener.Addr().String())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Failed to shut down metrics server", "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// objectOptions are the flags for how the object is stored: its storage
+// class, ACL, encryption, expiry and Object Lock settings
+type objectOptions struct {
+	storageClass      string
+	acl               string
+	sse               string
+	kmsKeyId          string
+	encryptionContext map[string]string
+	expires           string
+
+	lockMode        string
+	lockRetainUntil string
+	legalHold       string
+}
+
+// apply parses the options into cfg, with a usage error for any that are
+// invalid or missing the option they need
+func (o objectOptions) apply(cfg *stitch.UploadConfiguration) error {
+	cfg.SSEKMSKeyId = o.kmsKeyId
+	cfg.SSEKMSEncryptionContext = o.encryptionContext
+
+	if o.storageClass != "" {
+		parsed, err := stitch.ParseStorageClass(o.storageClass)
+
+		if err != nil {
+			return usagef("-storageClass: %v", err)
+		}
+
+		cfg.StorageClass = parsed
+	}
+
+	if o.acl != "" {
+		parsed, err := stitch.ParseCannedACL(o.acl)
+
+		if err != nil {
+			return usagef("-acl: %v", err)
+		}
+
+		cfg.ACL = parsed
+	}
+
+	if o.sse != "" {
+		parsed, err := stitch.ParseServerSideEncryption(o.sse)
+
+		if err != nil {
+			return usagef("-sse: %v", err)
+		}
+
+		cfg.ServerSideEncryption = parsed
+	}
+
+	if o.kmsKeyId != "" && cfg.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		return usagef("-kmsKeyId requires -sse aws:kms")
+	}
+
+	if len(o.encryptionContext) > 0 && cfg.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		return usagef("-kmsEncryptionContext requires -sse aws:kms")
+	}
+
+	if o.lockMode != "" {
+		parsed, err := stitch.ParseObjectLockMode(o.lockMode)
+
+		if err != nil {
+			return usagef("-objectLockMode: %v", err)
+		}
+
+		cfg.ObjectLockMode = parsed
+	}
+
+	if o.expires != "" {
+		parsed, err := parseExpiry(o.expires, time.Now())
+
+		if err != nil {
+			return usagef("-expires: %v", err)
+		}
+
+		if !parsed.After(time.Now()) {
+			return usagef("-expires must be in the future")
+		}
+
+		slog.Info("Setting the Expires header, the object is only deleted if a bucket lifecycle rule expires it", "expires", parsed.Format(time.RFC3339))
+		cfg.Expires = parsed
+	}
+
+	if o.lockRetainUntil != "" {
+		parsed, err := time.Parse(time.RFC3339, o.lockRetainUntil)
+
+		if err != nil {
+			return usagef("-objectLockRetainUntil: %v", err)
+		}
+
+		if !parsed.After(time.Now()) {
+			return usagef("-objectLockRetainUntil must be in the future")
+		}
+
+		cfg.ObjectLockRetainUntil = parsed
+	}
+
+	if (cfg.ObjectLockMode == "") != cfg.ObjectLockRetainUntil.IsZero() {
+		return usagef("-objectLockMode and -objectLockRetainUntil must be given together")
+	}
+
+	if o.legalHold != "" {
+		parsed, err := stitch.ParseObjectLockLegalHold(o.legalHold)
+
+		if err != nil {
+			return usagef("-objectLockLegalHold: %v", err)
+		}
+
+		cfg.ObjectLockLegalHold = parsed
+	}
+
+	return nil
+}
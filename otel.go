@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingShutdownTimeout bounds how long sending the last spans can hold up
+// exit
+const tracingShutdownTimeout = 5 * time.Second
+
+// startTracing exports spans over OTLP/HTTP for -otel. The exporter is set up
+// by the standard OTEL_EXPORTER_OTLP_* variables, such as
+// OTEL_EXPORTER_OTLP_ENDPOINT, and OTEL_SERVICE_NAME replaces the default
+// service name of stitch.
+func startTracing(ctx context.Context) (trace.Tracer, func(), error) {
+	exporter, err := otlptracehttp.New(ctx)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP trace exporter: %v", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "stitch")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to describe the trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+
+	slog.Info("Exporting traces over OTLP")
+
+	return provider.Tracer("github.com/awarrington0895/stitch"), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+
+		// Flushes the spans still batched
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("Failed to export traces", "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// jsonOutput leaves stdout to the final JSON document, with logs on stderr
+var jsonOutput bool
+
+// stdout and stderr take the human-readable output, both discarded by -quiet
+// so that only errors are shown
+var stdout io.Writer = os.Stdout
+var stderr io.Writer = os.Stderr
+
+type jsonResult struct {
+	Bucket        string  `json:"bucket"`
+	Key           string  `json:"key"`
+	URI           string  `json:"uri"`
+	Location      string  `json:"location,omitempty"`
+	File          string  `json:"file,omitempty"`
+	Line          int     `json:"line,omitempty"`
+	UploadId      string  `json:"uploadId,omitempty"`
+	ETag          string  `json:"etag,omitempty"`
+	SHA256        string  `json:"sha256,omitempty"`
+	PartCount     int     `json:"partCount"`
+	ChunkSize     int64   `json:"chunkSize,omitempty"`
+	FinalPartSize int64   `json:"finalPartSize,omitempty"`
+	BytesUploaded int64   `json:"bytesUploaded"`
+	DurationMs    int64   `json:"durationMs"`
+	MBPerSecond   float64 `json:"mbPerSecond,omitempty"`
+	Skipped       bool    `json:"skipped,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// newJSONResult describes an upload, including whatever partial progress it
+// made when err is set
+func newJSONResult(bucket string, key string, result *stitch.UploadResult, err error, duration time.Duration) jsonResult {
+	r := jsonResult{
+		Bucket:     bucket,
+		Key:        key,
+		URI:        objectURI(bucket, key),
+		DurationMs: duration.Milliseconds(),
+	}
+
+	if result != nil {
+		r.UploadId = result.UploadId
+		r.ETag = result.ETag
+		r.Location = result.Location
+		r.SHA256 = result.SHA256
+		r.PartCount = result.PartCount
+		r.ChunkSize = result.ChunkSize
+		r.FinalPartSize = result.FinalPartSize
+		r.BytesUploaded = result.TotalBytes
+		r.Skipped = result.Skipped
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// transferSummary is how many bytes a run uploaded over the time since it
+// started, to compare chunk size and concurrency settings by
+type transferSummary struct {
+	bytes   int64
+	elapsed time.Duration
+}
+
+func newTransferSummary(bytes int64, started time.Time) transferSummary {
+	return transferSummary{bytes: bytes, elapsed: time.Since(started)}
+}
+
+// mbPerSecond uses the same MB of 1024*1024 bytes as formatSize
+func (s transferSummary) mbPerSecond() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+
+	return float64(s.bytes) / (1024 * 1024) / s.elapsed.Seconds()
+}
+
+func (s transferSummary) String() string {
+	return fmt.Sprintf("Transferred %d bytes in %v, average %.1f MB/s", s.bytes, round(s.elapsed), s.mbPerSecond())
+}
+
+// withSummary adds the summary of the whole run to a JSON result, its
+// duration replacing the upload's so the throughput is over the same time
+func (r jsonResult) withSummary(s transferSummary) jsonResult {
+	summary := s.json()
+	r.DurationMs, r.MBPerSecond = summary.DurationMs, summary.MBPerSecond
+	return r
+}
+
+// jsonSummary ends the JSON array of a batch or fan-out with the totals of
+// the whole run, marked by summary to tell it from the results before it
+type jsonSummary struct {
+	Summary       bool    `json:"summary"`
+	BytesUploaded int64   `json:"bytesUploaded"`
+	DurationMs    int64   `json:"durationMs"`
+	MBPerSecond   float64 `json:"mbPerSecond"`
+}
+
+func (s transferSummary) json() jsonSummary {
+	return jsonSummary{
+		Summary:       true,
+		BytesUploaded: s.bytes,
+		DurationMs:    s.elapsed.Milliseconds(),
+		MBPerSecond:   math.Round(s.mbPerSecond()*100) / 100,
+	}
+}
+
+// partsLine describes how the object was split, for auditing how it was
+// uploaded
+func partsLine(result *stitch.UploadResult) string {
+	return fmt.Sprintf("Parts:  %d bytes in %d parts of %d bytes, final part %d bytes",
+		result.TotalBytes, result.PartCount, result.ChunkSize, result.FinalPartSize)
+}
+
+// printKeptUpload shows what a failed upload left in S3 for -keepOnFailure, so
+// it can be resumed
+func printKeptUpload(result *stitch.UploadResult) {
+	numbers := make([]string, 0, len(result.Parts))
+	for _, part := range result.Parts {
+		numbers = append(numbers, strconv.Itoa(int(aws.ToInt32(part.PartNumber))))
+	}
+
+	// stdout is left to the JSON document, which has the upload ID too
+	w := stdout
+	if jsonOutput {
+		w = stderr
+	}
+
+	fmt.Fprintf(w, "Kept upload %s with %d completed parts: %s\n", result.UploadId, len(result.Parts), strings.Join(numbers, ", "))
+	fmt.Fprintf(w, "Resume it with -uploadId %s, or abort it to stop paying for its parts\n", result.UploadId)
+}
+
+func objectURI(bucket string, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
+// objectLine is the last line of text output, for scripts to take the object
+// and its ETag from, with the quotes S3 puts around ETags left off
+func objectLine(bucket string, key string, etag string) string {
+	return fmt.Sprintf("%s etag=%s", objectURI(bucket, key), strings.Trim(etag, `"`))
+}
+
+func writeJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to write JSON output: %v", err)
+	}
+
+	return nil
+}
+
+// failure reports an error that ends the run as JSON when that output mode is
+// selected, then returns it for main to log
+func failure(bucket string, key string, err error) error {
+	if jsonOutput {
+		if writeErr := writeJSON(jsonResult{Bucket: bucket, Key: key, URI: objectURI(bucket, key), Error: err.Error()}); writeErr != nil {
+			return writeErr
+		}
+	}
+
+	return err
+}
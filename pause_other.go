@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "github.com/awarrington0895/stitch/stitch"
+
+// handlePauseSignals does nothing where SIGUSR1 and SIGUSR2 don't exist
+func handlePauseSignals(gate *stitch.PauseGate) func() {
+	return func() {}
+}
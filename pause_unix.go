@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// handlePauseSignals toggles gate on SIGUSR1 and resumes it on SIGUSR2, until
+// the returned function is called
+func handlePauseSignals(gate *stitch.PauseGate) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGUSR1 && gate.Pause() {
+					slog.Info("Paused, parts in flight will finish and the upload is kept open; send SIGUSR2 to resume", "pid", os.Getpid())
+				} else if gate.Resume() {
+					slog.Info("Resumed")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
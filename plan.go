@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+type planEntry struct {
+	File          string `json:"file"`
+	Bucket        string `json:"bucket"`
+	Key           string `json:"key"`
+	Size          int64  `json:"size"`
+	PartCount     int64  `json:"partCount"`
+	PartSize      int64  `json:"partSize"`
+	FinalPartSize int64  `json:"finalPartSize"`
+	PutObject     bool   `json:"putObject,omitempty"`
+}
+
+// printPlan describes how uploader would split each file into parts without
+// making any S3 calls, with the files of a batch planned as UploadFiles sends
+// them. Standard input can only be planned with its size given as stdinSize,
+// which is -1 otherwise.
+func printPlan(uploader *stitch.Uploader, cfg stitch.UploadConfiguration, files []stitch.FileUpload, batch bool, stdinSize int64) error {
+	var plan []planEntry
+	var total int64
+
+	for _, file := range files {
+		fileCfg := cfg
+		if batch {
+			fileCfg = cfg.BatchFile(file)
+		}
+
+		size := stdinSize
+
+		if file.FilePath != stitch.StdinPath {
+			info, err := os.Stat(file.FilePath)
+
+			if err != nil {
+				return fmt.Errorf("failed to stat file: %v", err)
+			}
+
+			size = info.Size()
+		} else if size < 0 {
+			return fmt.Errorf("cannot plan an upload from stdin without its size, give it with -size")
+		}
+
+		// The upload checks this before sending anything, so the plan fails too
+		if err := cfg.CheckPartSizesTotal(size); err != nil {
+			return err
+		}
+
+		chunkSize := cfg.ChunkSize
+		if len(cfg.PartSizes) == 0 {
+			chunkSize = cfg.EffectiveChunkSize(size)
+		}
+
+		parts := stitch.PartCount(size, chunkSize)
+
+		if limit := cfg.PartLimit(); parts > limit && len(cfg.PartSizes) == 0 {
+			return fmt.Errorf("%s needs %d parts at -chunkSize %d but at most %d are allowed, use -chunkSize %d or -autoChunk",
+				file.FilePath, parts, chunkSize, limit, stitch.ChunkSizeForParts(size, limit))
+		}
+
+		entry := planEntry{
+			File:      file.FilePath,
+			Bucket:    cfg.Bucket,
+			Key:       file.Key,
+			Size:      size,
+			PartCount: parts,
+			PartSize:  chunkSize,
+		}
+
+		if parts > 0 {
+			entry.FinalPartSize = size - (parts-1)*chunkSize
+		}
+
+		if len(cfg.PartSizes) > 0 {
+			entry.PartCount, entry.PartSize, entry.FinalPartSize = int64(len(cfg.PartSizes)), slices.Max(cfg.PartSizes), cfg.PartSizes[len(cfg.PartSizes)-1]
+		}
+
+		if uploader.PutsObject(fileCfg, size) {
+			entry.PartCount, entry.PartSize, entry.FinalPartSize, entry.PutObject = 1, size, size, true
+		}
+
+		plan = append(plan, entry)
+		total += size
+	}
+
+	if jsonOutput {
+		return writeJSON(plan)
+	}
+
+	for _, entry := range plan {
+		fmt.Fprintf(stdout, "%s -> s3://%s/%s\n", entry.File, entry.Bucket, entry.Key)
+
+		if entry.PutObject {
+			fmt.Fprintf(stdout, "  %d bytes in a single PutObject\n", entry.Size)
+			continue
+		}
+
+		fmt.Fprintf(stdout, "  %d bytes in %d parts of %d bytes, final part %d bytes\n", entry.Size, entry.PartCount, entry.PartSize, entry.FinalPartSize)
+	}
+
+	fmt.Fprintf(stdout, "Total: %d bytes in %d files\n", total, len(plan))
+	return nil
+}
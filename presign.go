@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// presignTokenEnv is sent as a bearer token to the presign service when set
+const presignTokenEnv = "STITCH_PRESIGN_TOKEN"
+
+// presignClient uploads through presigned URLs handed out by a trusted
+// service, so no AWS credentials are needed where stitch runs.
+//
+// For every S3 request stitch first POSTs a JSON presign request to the
+// service URL:
+//
+//	{"operation": "UploadPart", "bucket": "b", "key": "k", "uploadId": "...", "partNumber": 3}
+//
+// operation is one of CreateMultipartUpload, UploadPart,
+// CompleteMultipartUpload, AbortMultipartUpload, or PutObject for files too
+// small for a multipart upload. uploadId is set for every operation but
+// CreateMultipartUpload and PutObject, and partNumber only for UploadPart.
+// The service decides whether the caller may make the request and answers
+// 200 with the presigned URL and any headers that were signed into it:
+//
+//	{"url": "https://b.s3.amazonaws.com/k?partNumber=3&uploadId=...&X-Amz-Signature=...", "headers": {"x-amz-storage-class": "STANDARD_IA"}}
+//
+// stitch then sends the request to the URL exactly as S3 expects it: POST for
+// create and complete, PUT with the data for a part or object, and DELETE for
+// abort. Object settings such as the storage class or metadata are the
+// service's to sign into the create URL, because S3 rejects x-amz-* headers
+// that aren't part of the signature. Any other response from the service
+// fails the request.
+type presignClient struct {
+	serviceURL string
+	token      string
+	http       *http.Client
+}
+
+func newPresignClient(serviceURL string, token string) *presignClient {
+	return &presignClient{serviceURL: serviceURL, token: token, http: &http.Client{}}
+}
+
+type presignRequest struct {
+	Operation  string `json:"operation"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	UploadId   string `json:"uploadId,omitempty"`
+	PartNumber int32  `json:"partNumber,omitempty"`
+}
+
+type presignResponse struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// presignError is an S3 error response, keeping the status code so retries
+// treat server errors and throttling the same as from the SDK
+type presignError struct {
+	status int
+	api    *smithy.GenericAPIError
+}
+
+func (e *presignError) Error() string {
+	return fmt.Sprintf("presigned request failed with status %d: %v", e.status, e.api)
+}
+
+func (e *presignError) Unwrap() error {
+	return e.api
+}
+
+func (e *presignError) HTTPStatusCode() int {
+	return e.status
+}
+
+// s3Error is the XML body of an S3 error response
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (c *presignClient) presign(ctx context.Context, req presignRequest) (*presignResponse, error) {
+	body, err := json.Marshal(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode presign request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serviceURL, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create presign request: %v", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(httpReq)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign %s: %w", req.Operation, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &presignError{
+			status: resp.StatusCode,
+			api:    &smithy.GenericAPIError{Code: "PresignFailed", Message: fmt.Sprintf("presign service refused %s: %s", req.Operation, bytes.TrimSpace(message))},
+		}
+	}
+
+	var presigned presignResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&presigned); err != nil {
+		return nil, fmt.Errorf("failed to decode presign response for %s: %v", req.Operation, err)
+	}
+
+	if presigned.URL == "" {
+		return nil, fmt.Errorf("presign response for %s has no url", req.Operation)
+	}
+
+	return &presigned, nil
+}
+
+// do presigns req and sends it, decoding an XML response into out when given
+func (c *presignClient) do(ctx context.Context, req presignRequest, method string, body io.Reader, size int64, header http.Header, out any) (http.Header, error) {
+	presigned, err := c.presign(ctx, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, presigned.URL, body)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", req.Operation, err)
+	}
+
+	// S3 rejects chunked uploads to a presigned URL, so the length is always
+	// sent even for readers net/http can't measure
+	if body != nil && size > 0 {
+		httpReq.ContentLength = size
+	}
+
+	for name, values := range header {
+		httpReq.Header[name] = values
+	}
+
+	for name, value := range presigned.Headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := c.http.Do(httpReq)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %w", req.Operation, err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", req.Operation, err)
+	}
+
+	// CompleteMultipartUpload can fail with an error body in a 200 response
+	var errResp s3Error
+	errorBody := len(data) > 0 && xml.Unmarshal(data, &errResp) == nil
+
+	if resp.StatusCode >= http.StatusMultipleChoices || errorBody {
+		if errResp.Code == "" {
+			errResp.Code = http.StatusText(resp.StatusCode)
+		}
+
+		return nil, &presignError{status: resp.StatusCode, api: &smithy.GenericAPIError{Code: errResp.Code, Message: errResp.Message}}
+	}
+
+	if out != nil {
+		if err := xml.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("failed to decode %s response: %v", req.Operation, err)
+		}
+	}
+
+	return resp.Header, nil
+}
+
+// objectHeaders are the plain HTTP headers of a new object, which can be sent
+// without being signed
+func objectHeaders(contentType *string, cacheControl *string, contentDisposition *string, contentEncoding *string, expires *time.Time) http.Header {
+	header := http.Header{}
+
+	for name, value := range map[string]*string{
+		"Content-Type":        contentType,
+		"Cache-Control":       cacheControl,
+		"Content-Disposition": contentDisposition,
+		"Content-Encoding":    contentEncoding,
+	} {
+		if value != nil {
+			header.Set(name, *value)
+		}
+	}
+
+	if expires != nil {
+		header.Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+
+	return header
+}
+
+func (c *presignClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+
+	header := objectHeaders(params.ContentType, params.CacheControl, params.ContentDisposition, params.ContentEncoding, params.Expires)
+	req := presignRequest{Operation: "CreateMultipartUpload", Bucket: aws.ToString(params.Bucket), Key: aws.ToString(params.Key)}
+
+	if _, err := c.do(ctx, req, http.MethodPost, nil, 0, header, &result); err != nil {
+		return nil, err
+	}
+
+	return &s3.CreateMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, UploadId: aws.String(result.UploadId)}, nil
+}
+
+func (c *presignClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	req := presignRequest{
+		Operation:  "UploadPart",
+		Bucket:     aws.ToString(params.Bucket),
+		Key:        aws.ToString(params.Key),
+		UploadId:   aws.ToString(params.UploadId),
+		PartNumber: aws.ToInt32(params.PartNumber),
+	}
+
+	header, err := c.do(ctx, req, http.MethodPut, params.Body, aws.ToInt64(params.ContentLength), nil, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.UploadPartOutput{ETag: aws.String(header.Get("ETag"))}, nil
+}
+
+func (c *presignClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	type completedPart struct {
+		PartNumber int32  `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+
+	upload := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+
+	for _, part := range params.MultipartUpload.Parts {
+		upload.Parts = append(upload.Parts, completedPart{PartNumber: aws.ToInt32(part.PartNumber), ETag: aws.ToString(part.ETag)})
+	}
+
+	body, err := xml.Marshal(upload)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode completed parts: %v", err)
+	}
+
+	var result struct {
+		Location string `xml:"Location"`
+		ETag     string `xml:"ETag"`
+	}
+
+	header := http.Header{"Content-Type": {"application/xml"}}
+	req := presignRequest{Operation: "CompleteMultipartUpload", Bucket: aws.ToString(params.Bucket), Key: aws.ToString(params.Key), UploadId: aws.ToString(params.UploadId)}
+
+	if _, err := c.do(ctx, req, http.MethodPost, bytes.NewReader(body), int64(len(body)), header, &result); err != nil {
+		return nil, err
+	}
+
+	return &s3.CompleteMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, ETag: aws.String(result.ETag), Location: aws.String(result.Location)}, nil
+}
+
+func (c *presignClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	req := presignRequest{Operation: "AbortMultipartUpload", Bucket: aws.ToString(params.Bucket), Key: aws.ToString(params.Key), UploadId: aws.ToString(params.UploadId)}
+
+	if _, err := c.do(ctx, req, http.MethodDelete, nil, 0, nil, nil); err != nil {
+		return nil, err
+	}
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (c *presignClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	header := objectHeaders(params.ContentType, params.CacheControl, params.ContentDisposition, params.ContentEncoding, params.Expires)
+	req := presignRequest{Operation: "PutObject", Bucket: aws.ToString(params.Bucket), Key: aws.ToString(params.Key)}
+
+	respHeader, err := c.do(ctx, req, http.MethodPut, params.Body, aws.ToInt64(params.ContentLength), header, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.PutObjectOutput{ETag: aws.String(respHeader.Get("ETag"))}, nil
+}
+
+// presignUnsupported are the flags that need a signed x-amz-* header or a
+// request the presign contract doesn't cover
+var presignUnsupported = []string{
+	"accelerate", "acl", "autoRegion", "checksumAlgorithm", "cleanup", "computeEtag", "configFile", "contentMD5",
+	"credentialsFile", "expectedBucketOwner", "ifMatch", "ifNoneMatch", "ifNotExists", "kmsEncryptionContext",
+	"kmsKeyId", "listParts", "meta", "objectLockLegalHold", "objectLockMode", "objectLockRetainUntil",
+	"requestPayer", "sdkMaxAttempts", "sdkRetryMode", "sse", "storageClass", "tag", "uploadId", "useDualstack",
+	"useFIPS", "verify",
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// progressRecord is the -progressFile document: the multipart upload an
+// interrupted run leaves behind and the parts it stored, enough to resume it
+// with -uploadId or abort it by hand
+type progressRecord struct {
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	UploadId  string         `json:"uploadId"`
+	ChunkSize int64          `json:"chunkSize,omitempty"`
+	Parts     []progressPart `json:"parts"`
+}
+
+type progressPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// progressRecorder rewrites the progress file after every stored part. It is
+// used as stitch.Uploader.PartFunc, whose calls are serialized.
+type progressRecorder struct {
+	path   string
+	record progressRecord
+}
+
+func newProgressRecorder(path string, bucket string, key string, chunkSize int64) *progressRecorder {
+	return &progressRecorder{path: path, record: progressRecord{Bucket: bucket, Key: key, ChunkSize: chunkSize}}
+}
+
+// checkProgressChunkSize compares the chunk size a resume uses with the one
+// the progress file recorded for the upload, since any other splits the file
+// at different offsets than the stored parts. A mismatch is only an error with
+// requireAligned; otherwise the parts themselves are checked during the
+// resume.
+func checkProgressChunkSize(path string, uploadId string, chunkSize int64, requireAligned bool) error {
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read progress file: %v", err)
+	}
+
+	var record progressRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("failed to parse progress file %s: %v", path, err)
+	}
+
+	if record.UploadId != uploadId || record.ChunkSize == 0 || record.ChunkSize == chunkSize {
+		return nil
+	}
+
+	if requireAligned {
+		return usagef("upload %s was started with a chunk size of %d, not %d; resume it with -chunkSize %d",
+			uploadId, record.ChunkSize, chunkSize, record.ChunkSize)
+	}
+
+	slog.Warn("Resuming with a different chunk size than the upload was started with", "uploadId", uploadId,
+		"chunkSize", chunkSize, "original", record.ChunkSize)
+	return nil
+}
+
+func (r *progressRecorder) partStored(uploadId string, part types.CompletedPart) {
+	r.record.UploadId = uploadId
+	r.record.Parts = append(r.record.Parts, progressPart{PartNumber: aws.ToInt32(part.PartNumber), ETag: aws.ToString(part.ETag)})
+
+	slices.SortFunc(r.record.Parts, func(a, b progressPart) int {
+		return int(a.PartNumber - b.PartNumber)
+	})
+
+	data, err := json.MarshalIndent(r.record, "", "  ")
+
+	if err == nil {
+		err = writeFileAtomic(r.path, data)
+	}
+
+	// The upload itself is fine, so a failed write doesn't stop it
+	if err != nil {
+		slog.Warn("Failed to write progress file", "file", r.path, "error", err)
+	}
+}
+
+// remove deletes the progress file once the upload completed, since there is
+// nothing left to resume or clean up
+func (r *progressRecorder) remove() {
+	if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove progress file", "file", r.path, "error", err)
+	}
+}
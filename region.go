@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// bucketRegionHeader is sent by S3 with HeadBucket responses, including the
+// redirect for a bucket in another region
+const bucketRegionHeader = "X-Amz-Bucket-Region"
+
+// clientForBucket checks the bucket and returns a client for its region,
+// which is client itself unless the bucket is elsewhere and autoRegion allows
+// switching to it. A client using Transfer Acceleration also has the bucket
+// checked for it.
+func clientForBucket(ctx context.Context, client *s3.Client, bucket string, autoRegion bool) (*s3.Client, error) {
+	bucketClient, err := regionClient(ctx, client, bucket, autoRegion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bucketClient.Options().UseAccelerate {
+		if err := checkAccelerate(ctx, bucketClient, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	return bucketClient, nil
+}
+
+// regionClient returns a client for the bucket's region, as clientForBucket
+func regionClient(ctx context.Context, client *s3.Client, bucket string, autoRegion bool) (*s3.Client, error) {
+	region, err := checkBucket(ctx, client, bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if region == "" {
+		return client, nil
+	}
+
+	if !autoRegion {
+		return nil, usagef("bucket %s is in region %s, not %s; use -region %s or -autoRegion",
+			bucket, region, client.Options().Region, region)
+	}
+
+	if client.Options().EndpointOptions.UseFIPSEndpoint == aws.FIPSEndpointStateEnabled && !fipsRegions[region] {
+		return nil, usagef("bucket %s is in region %s, which has no S3 FIPS endpoint", bucket, region)
+	}
+
+	slog.Info("Switching to the bucket's region", "bucket", bucket, "region", region)
+
+	// The new client shares the credentials cache, so refreshing the
+	// credentials covers both
+	return s3.New(client.Options(), func(o *s3.Options) {
+		o.Region = region
+	}), nil
+}
+
+// checkBucket heads the bucket before anything is uploaded, since a missing
+// bucket or one in another region otherwise fails the first request with a
+// bare 404 or redirect. It returns the bucket's region when it differs from
+// the client's, or "" when it matches or can't be told.
+func checkBucket(ctx context.Context, client *s3.Client, bucket string) (string, error) {
+	clientRegion := client.Options().Region
+
+	resp, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+
+	if err == nil {
+		if region := aws.ToString(resp.BucketRegion); region != "" && region != clientRegion {
+			return region, nil
+		}
+
+		return "", nil
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return "", fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+	}
+
+	// A redirect or a signature for the wrong region both name the right one
+	if region := responseErr.Response.Header.Get(bucketRegionHeader); region != "" && region != clientRegion {
+		return region, nil
+	}
+
+	switch responseErr.HTTPStatusCode() {
+	case http.StatusNotFound:
+		return "", fmt.Errorf("bucket %s does not exist: %w", bucket, err)
+	case http.StatusForbidden:
+		// Permission to upload doesn't imply permission to head the bucket
+		slog.Debug("Not allowed to check the bucket, skipping the region check", "bucket", bucket)
+		return "", nil
+	}
+
+	return "", fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+}
+
+// checkAccelerate makes sure the bucket has Transfer Acceleration enabled,
+// since the accelerated endpoint otherwise rejects every request. Not being
+// allowed to read the setting skips the check.
+func checkAccelerate(ctx context.Context, client *s3.Client, bucket string) error {
+	// The setting is read from the regular endpoint, as the accelerated one
+	// doesn't serve it
+	resp, err := client.GetBucketAccelerateConfiguration(ctx, &s3.GetBucketAccelerateConfigurationInput{Bucket: aws.String(bucket)},
+		func(o *s3.Options) {
+			o.UseAccelerate = false
+		})
+
+	if err != nil {
+		slog.Debug("Couldn't check Transfer Acceleration, skipping the check", "bucket", bucket, "error", err)
+		return nil
+	}
+
+	if resp.Status != types.BucketAccelerateStatusEnabled {
+		return usagef("bucket %s doesn't have Transfer Acceleration enabled, enable it or leave out -accelerate", bucket)
+	}
+
+	return nil
+}
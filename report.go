@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// failedFile is one entry of the -failureReport file
+type failedFile struct {
+	File          string `json:"file"`
+	Line          int    `json:"line,omitempty"`
+	Key           string `json:"key"`
+	Error         string `json:"error"`
+	PartsUploaded int    `json:"partsUploaded"`
+	UploadId      string `json:"uploadId,omitempty"`
+}
+
+// writeFailureReport writes every file of the batch that didn't complete to
+// path as a JSON array. It is written even when nothing failed, so a report
+// left from an earlier run is never mistaken for this one. lines gives the
+// input list line of each file, when there is one.
+func writeFailureReport(path string, batch *stitch.BatchResult, lines map[stitch.FileUpload]int) error {
+	report := make([]failedFile, 0, len(batch.Failed))
+
+	for _, file := range batch.Failed {
+		entry := failedFile{File: file.FilePath, Key: file.Key, Line: lines[file.FileUpload], Error: file.Err.Error()}
+
+		if file.Result != nil {
+			entry.PartsUploaded = file.Result.PartCount
+			entry.UploadId = file.Result.UploadId
+		}
+
+		report = append(report, entry)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("failed to encode failure report: %v", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write failure report: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// skipUnchanged reports whether state records the file of cfg as unchanged
+// since its last upload, printing that it was skipped
+func skipUnchanged(state *uploadState, cfg stitch.UploadConfiguration, force bool) (bool, error) {
+	pending, _, err := state.pending(cfg.Bucket, []stitch.FileUpload{{FilePath: cfg.FilePath, Key: cfg.Key}}, force)
+
+	if err != nil {
+		return false, failure(cfg.Bucket, cfg.Key, err)
+	}
+
+	if len(pending) > 0 {
+		return false, nil
+	}
+
+	if jsonOutput {
+		return true, writeJSON(jsonResult{Bucket: cfg.Bucket, Key: cfg.Key, File: cfg.FilePath, Skipped: true})
+	}
+
+	fmt.Fprintln(stdout, "Skipped, unchanged since last upload")
+	return true, nil
+}
+
+// uploadSingleFile uploads the file, or standard input, of size bytes or -1
+// when unknown, and prints the outcome. With state the upload is recorded
+// once it succeeds, and with progressPath the parts stored are written there
+// until it does. An upload left open by NoComplete is written to
+// completionPath. The summary is timed from started, when the run began.
+func uploadSingleFile(ctx context.Context, uploader *stitch.Uploader, cfg stitch.UploadConfiguration, size int64, state *uploadState, progressPath string, completionPath string, metrics *uploadMetrics, started time.Time) error {
+	var recorder *progressRecorder
+	if progressPath != "" {
+		recorder = newProgressRecorder(progressPath, cfg.Bucket, cfg.Key, cfg.EffectiveChunkSize(size))
+		uploader.PartFunc = recorder.partStored
+	}
+
+	start := time.Now()
+
+	var result *stitch.UploadResult
+	var err error
+	if cfg.FilePath == stitch.StdinPath {
+		result, err = uploader.UploadReader(ctx, cfg, os.Stdin, size)
+	} else {
+		result, err = uploader.Upload(ctx, cfg)
+	}
+	err = accessDeniedHint(cfg, err)
+	metrics.uploadFinished(err)
+
+	if err == nil && state != nil {
+		state.record(stitch.FileUpload{FilePath: cfg.FilePath, Key: cfg.Key}, result)
+		saveState(state)
+	}
+
+	if err == nil {
+		printTimingSummary(stderr, result.PartTimings)
+
+		if recorder != nil {
+			recorder.remove()
+		}
+	}
+
+	// A failure before anything was uploaded still took the run's time
+	var bytes int64
+	if result != nil {
+		bytes = result.TotalBytes
+	}
+	summary := newTransferSummary(bytes, started)
+
+	if err == nil && cfg.NoComplete && !result.Skipped {
+		if writeErr := writeCompletion(newCompletionRecord(cfg, result), completionPath); writeErr != nil {
+			return writeErr
+		}
+
+		// Without a file the record is the whole output
+		if completionPath == "" {
+			return nil
+		}
+
+		if !jsonOutput {
+			fmt.Fprintf(stdout, "Stored %d parts of upload %s without completing it, parts written to %s\n",
+				result.PartCount, result.UploadId, completionPath)
+			return nil
+		}
+	}
+
+	if jsonOutput {
+		if writeErr := writeJSON(newJSONResult(cfg.Bucket, cfg.Key, result, err, time.Since(start)).withSummary(summary)); writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	if err != nil {
+		if (cfg.KeepOnFailure || cfg.NoComplete) && result != nil && result.UploadId != "" {
+			printKeptUpload(result)
+		}
+
+		return err
+	}
+
+	if result.Skipped {
+		fmt.Fprintln(stdout, "Skipped, already present")
+		return nil
+	}
+
+	fmt.Fprintln(stdout, "Upload completed successfully!")
+
+	if len(cfg.Metadata) > 0 {
+		fmt.Fprintln(stdout, "Metadata: ", keyValueFlag(cfg.Metadata))
+	}
+
+	if len(cfg.Tags) > 0 {
+		fmt.Fprintln(stdout, "Tags: ", keyValueFlag(cfg.Tags))
+	}
+
+	fmt.Fprintln(stdout, partsLine(result))
+	fmt.Fprintln(stdout, "SHA-256: ", result.SHA256)
+	fmt.Fprintln(stdout, summary)
+	fmt.Fprintln(stdout, objectLine(cfg.Bucket, cfg.Key, result.ETag))
+
+	return nil
+}
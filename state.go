@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// uploadState is the -stateFile record of files already uploaded, so files
+// that haven't changed since can be skipped on the next run
+type uploadState struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]stateEntry
+	// seen holds each pending file's size and mtime from before its upload,
+	// so a file modified mid-upload is sent again next time
+	seen    map[string]stateEntry
+	updated map[string]stateEntry
+}
+
+type stateEntry struct {
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	ETag    string    `json:"etag,omitempty"`
+}
+
+// loadUploadState reads the state file at path, which may not exist yet
+func loadUploadState(path string) (*uploadState, error) {
+	unlock, err := lockStateFile(path, false)
+
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := readStateEntries(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploadState{
+		path:    path,
+		entries: entries,
+		seen:    map[string]stateEntry{},
+		updated: map[string]stateEntry{},
+	}, nil
+}
+
+func readStateEntries(path string) (map[string]stateEntry, error) {
+	entries := map[string]stateEntry{}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+
+	return entries, nil
+}
+
+// saveState only warns on failure, since the uploads themselves succeeded and
+// the worst outcome is sending the files again next time
+func saveState(state *uploadState) {
+	if err := state.save(); err != nil {
+		slog.Warn("Failed to save state file", "file", state.path, "error", err)
+	}
+}
+
+// pending returns the files whose size or mtime changed since they were last
+// uploaded to the same bucket and key, and the paths of the rest. With force
+// every file is pending, but each is still recorded once uploaded.
+func (s *uploadState) pending(bucket string, files []stitch.FileUpload, force bool) ([]stitch.FileUpload, []string, error) {
+	var pending []stitch.FileUpload
+	var unchanged []string
+
+	for _, file := range files {
+		path, err := filepath.Abs(file.FilePath)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		info, err := os.Stat(file.FilePath)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat file: %v", err)
+		}
+
+		current := stateEntry{Bucket: bucket, Key: file.Key, Size: info.Size(), ModTime: info.ModTime()}
+		previous, ok := s.entries[path]
+
+		if !force && ok && previous.Bucket == current.Bucket && previous.Key == current.Key &&
+			previous.Size == current.Size && previous.ModTime.Equal(current.ModTime) {
+			unchanged = append(unchanged, file.FilePath)
+			continue
+		}
+
+		// A directory's files are checked as they are found, while those
+		// found earlier are recorded by the uploads
+		s.mu.Lock()
+		s.seen[path] = current
+		s.mu.Unlock()
+
+		pending = append(pending, file)
+	}
+
+	return pending, unchanged, nil
+}
+
+// record notes a completed upload of a file returned by pending
+func (s *uploadState) record(file stitch.FileUpload, result *stitch.UploadResult) {
+	path, err := filepath.Abs(file.FilePath)
+
+	if err != nil || result == nil || result.Skipped {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.seen[path]
+
+	if !ok {
+		return
+	}
+
+	entry.SHA256 = result.SHA256
+	entry.ETag = result.ETag
+	s.updated[path] = entry
+}
+
+// save merges this run's uploads into the state file. The file is re-read
+// under an exclusive lock so runs sharing it don't drop each other's entries,
+// and replaced with a rename so readers never see it half written.
+func (s *uploadState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.updated) == 0 {
+		return nil
+	}
+
+	unlock, err := lockStateFile(s.path, true)
+
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readStateEntries(s.path)
+
+	if err != nil {
+		return err
+	}
+
+	for path, entry := range s.updated {
+		entries[path] = entry
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a rename, so readers never
+// see the file half written
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
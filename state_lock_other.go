@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockStateFile is a no-op where flock isn't available. Saves still replace
+// the state file atomically, but concurrent runs may drop each other's entries.
+func lockStateFile(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// Files of a directory are checked against the state as the walk finds them,
+// while those found before are already uploading and being recorded
+func TestDirectoryStreamWithStateFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for i := range 50 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%02d", i)), []byte{byte(i)}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := loadUploadState(filepath.Join(t.TempDir(), "state.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := directoryFiles(context.Background(), dir, "prefix/", false, &fileKeys{normalize: true}, state, "bucket", false)
+
+	recorded := 0
+	for file := range found.files {
+		state.record(file, &stitch.UploadResult{SHA256: "sha", ETag: "etag"})
+		recorded++
+	}
+
+	if _, err := found.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorded != 50 || len(state.updated) != 50 {
+		t.Errorf("recorded %d of %d files found, want all 50", len(state.updated), recorded)
+	}
+}
@@ -0,0 +1,345 @@
+package stitch
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileUpload pairs a local file with the key it is uploaded to.
+type FileUpload struct {
+	FilePath string
+	Key      string
+}
+
+// FileResult is the outcome of uploading one file in a batch. Err is set when
+// the file failed, otherwise Result describes the upload.
+type FileResult struct {
+	FileUpload
+
+	Result   *UploadResult
+	Err      error
+	Duration time.Duration
+}
+
+// BatchResult summarizes UploadFiles. Files holds every result in the order
+// the files were given, which Uploaded and Failed split by outcome.
+type BatchResult struct {
+	Files    []FileResult
+	Uploaded []FileResult
+	Failed   []FileResult
+}
+
+// DirectoryFiles walks dir and returns every regular file beneath it, keyed by
+// keyPrefix followed by its path relative to dir with forward slashes on
+// every platform. Symlinks are skipped unless followSymlinks is set, in which
+// case a link to a file is uploaded under the link's key and a link to a
+// directory is walked as if the directory were at the link. A link back to a
+// directory it is inside of is skipped to avoid walking in a loop. Any other
+// entries, such as devices or broken links, are returned as skipped.
+func DirectoryFiles(dir string, keyPrefix string, followSymlinks bool) (files []FileUpload, skipped []string, err error) {
+	w := &directoryWalker{
+		followSymlinks: followSymlinks,
+		found: func(file FileUpload) error {
+			files = append(files, file)
+			return nil
+		},
+	}
+
+	if err := w.walk(dir, keyPrefix, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to walk %s: %v", dir, err)
+	}
+
+	return files, w.skipped, nil
+}
+
+// DirectoryFileStream walks dir like DirectoryFiles, but sends each file on
+// the returned channel as soon as it is found, so a batch from a huge tree
+// can start uploading long before the walk is done. The channel is closed
+// when the walk ends, after which wait returns the skipped entries and the
+// error the walk stopped at, if any. The files already sent are unaffected by
+// an error. Cancelling ctx stops the walk.
+func DirectoryFileStream(ctx context.Context, dir string, keyPrefix string, followSymlinks bool) (files <-chan FileUpload, wait func() ([]string, error)) {
+	found := make(chan FileUpload)
+	done := make(chan struct{})
+
+	w := &directoryWalker{
+		followSymlinks: followSymlinks,
+		found: func(file FileUpload) error {
+			select {
+			case found <- file:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+
+	var err error
+
+	go func() {
+		defer close(done)
+		defer close(found)
+
+		if walkErr := w.walk(dir, keyPrefix, nil); walkErr != nil {
+			err = fmt.Errorf("failed to walk %s: %w", dir, walkErr)
+		}
+	}()
+
+	return found, func() ([]string, error) {
+		<-done
+		return w.skipped, err
+	}
+}
+
+type directoryWalker struct {
+	followSymlinks bool
+
+	// found is called with every file, and stops the walk with its error
+	found   func(FileUpload) error
+	skipped []string
+}
+
+// walk adds the files beneath dir. It walks the directory's real path so
+// links can be compared against it, while file paths keep the path they were
+// reached by. links holds the real paths of the links followed to get here.
+func (w *directoryWalker) walk(dir string, keyPrefix string, links []string) error {
+	root, err := filepath.EvalSymlinks(dir)
+
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return err
+		}
+
+		filePath := filepath.Join(dir, rel)
+		key := directoryKey(keyPrefix, rel, filepath.Separator)
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if d.Type().IsRegular() {
+			return w.found(FileUpload{FilePath: filePath, Key: key})
+		}
+
+		if d.Type()&fs.ModeSymlink == 0 || !w.followSymlinks {
+			w.skipped = append(w.skipped, filePath)
+			return nil
+		}
+
+		target, err := filepath.EvalSymlinks(path)
+
+		if err != nil {
+			w.skipped = append(w.skipped, filePath+" (broken symlink)")
+			return nil
+		}
+
+		info, err := os.Stat(target)
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			return w.found(FileUpload{FilePath: filePath, Key: key})
+		case info.IsDir() && loops(target, append(links, path)):
+			w.skipped = append(w.skipped, filePath+" (symlink loop)")
+		case info.IsDir():
+			return w.walk(filePath, key+"/", append(links, path))
+		default:
+			w.skipped = append(w.skipped, filePath)
+		}
+
+		return nil
+	})
+}
+
+// directoryKey is keyPrefix followed by rel, the file's path below the
+// walked directory, with rel's separators turned into the slashes S3 keys
+// use. filepath.ToSlash does the same but only for the separator of the
+// platform it runs on.
+func directoryKey(keyPrefix string, rel string, separator rune) string {
+	if separator != '/' {
+		rel = strings.ReplaceAll(rel, string(separator), "/")
+	}
+
+	return keyPrefix + rel
+}
+
+// loops reports whether target contains any of the links followed to reach
+// it, meaning walking it would come back around to the same links
+func loops(target string, links []string) bool {
+	for _, link := range links {
+		rel, err := filepath.Rel(target, link)
+
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GlobFiles expands pattern with filepath.Glob and keys each regular file it
+// matches by keyPrefix followed by its base name. Matching nothing is an error.
+func GlobFiles(pattern string, keyPrefix string) ([]FileUpload, error) {
+	matches, err := filepath.Glob(pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+
+	var files []FileUpload
+
+	for _, match := range matches {
+		info, err := os.Stat(match)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %v", match, err)
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, FileUpload{FilePath: match, Key: keyPrefix + filepath.Base(match)})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match %q", pattern)
+	}
+
+	return files, nil
+}
+
+// HasGlobMeta reports whether path contains any filepath.Match metacharacters.
+func HasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// UploadFiles uploads each file using cfg for everything but the file path
+// and key, running up to FileConcurrency files at once. Their parts share a
+// single budget of Concurrency requests in flight, and each file is completed
+// as soon as its own parts are done. Files smaller than MinimumChunkSize, or
+// MultipartThreshold when that is larger, are sent with a single PutObject,
+// except with Gzip as their compressed size isn't known. A failed file
+// doesn't stop the rest of the batch.
+func (u *Uploader) UploadFiles(ctx context.Context, cfg UploadConfiguration, files []FileUpload) *BatchResult {
+	queued := make(chan FileUpload)
+
+	go func() {
+		defer close(queued)
+
+		for _, file := range files {
+			queued <- file
+		}
+	}()
+
+	return u.UploadFileStream(ctx, cfg, queued)
+}
+
+// UploadFileStream is UploadFiles for files sent on a channel, such as by
+// DirectoryFileStream, starting each as soon as a file slot is free instead
+// of once every file is known. It returns when files is closed and every
+// file taken from it is done, with the results in the order they were sent.
+func (u *Uploader) UploadFileStream(ctx context.Context, cfg UploadConfiguration, files <-chan FileUpload) *BatchResult {
+	type batchJob struct {
+		index int
+		file  FileUpload
+	}
+
+	// results grows as files arrive, so workers fill in theirs under mu
+	var results []FileResult
+	var mu sync.Mutex
+
+	jobs := make(chan batchJob)
+	budget := make(partBudget, max(u.Concurrency, 1))
+
+	var wg sync.WaitGroup
+
+	for range max(u.FileConcurrency, 1) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				result := u.uploadBatchFile(ctx, cfg, job.file, budget)
+
+				mu.Lock()
+				results[job.index] = result
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for file := range files {
+		mu.Lock()
+		results = append(results, FileResult{FileUpload: file})
+		index := len(results) - 1
+		mu.Unlock()
+
+		jobs <- batchJob{index: index, file: file}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	batch := &BatchResult{Files: results}
+
+	for _, result := range results {
+		if result.Err != nil {
+			batch.Failed = append(batch.Failed, result)
+		} else {
+			batch.Uploaded = append(batch.Uploaded, result)
+		}
+	}
+
+	return batch
+}
+
+// BatchFile is the configuration UploadFiles uploads file with
+func (cfg UploadConfiguration) BatchFile(file FileUpload) UploadConfiguration {
+	cfg.FilePath = file.FilePath
+	cfg.Key = file.Key
+
+	// Every file goes through the whole upload, gzip included, with those
+	// too small for a multipart upload sent with a single PutObject
+	cfg.MultipartThreshold = max(cfg.MultipartThreshold, MinimumChunkSize)
+
+	return cfg
+}
+
+func (u *Uploader) uploadBatchFile(ctx context.Context, cfg UploadConfiguration, file FileUpload, budget partBudget) FileResult {
+	if ctx.Err() != nil {
+		return FileResult{FileUpload: file, Err: ctx.Err()}
+	}
+
+	fileCfg := cfg.BatchFile(file)
+
+	u.logger().Info("Uploading file", "file", file.FilePath, "bucket", cfg.Bucket, "key", file.Key)
+
+	start := time.Now()
+
+	result, err := u.upload(ctx, fileCfg, budget)
+
+	if err != nil {
+		u.logger().Error("Failed to upload file", "file", file.FilePath, "error", err)
+	}
+
+	return FileResult{FileUpload: file, Result: result, Err: err, Duration: time.Since(start)}
+}
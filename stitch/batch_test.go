@@ -0,0 +1,92 @@
+package stitch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDirectoryKeyFromNestedPaths(t *testing.T) {
+	for _, tc := range []struct {
+		rel       string
+		separator rune
+		want      string
+	}{
+		{"file.txt", '/', "backup/file.txt"},
+		{"a/b/c/file.txt", '/', "backup/a/b/c/file.txt"},
+		{`file.txt`, '\\', "backup/file.txt"},
+		{`a\b\c\file.txt`, '\\', "backup/a/b/c/file.txt"},
+	} {
+		if got := directoryKey("backup/", tc.rel, tc.separator); got != tc.want {
+			t.Errorf("key for %q with separator %q is %q, want %q", tc.rel, tc.separator, got, tc.want)
+		}
+	}
+}
+
+func TestDirectoryFilesKeyNestedFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, rel := range []string{"top.txt", "a/middle.txt", "a/b/c/deep.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(rel), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _, err := DirectoryFiles(dir, "backup/", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, file := range files {
+		keys = append(keys, file.Key)
+	}
+	slices.Sort(keys)
+
+	if want := []string{"backup/a/b/c/deep.txt", "backup/a/middle.txt", "backup/top.txt"}; !slices.Equal(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+}
+
+func TestAutoChunkSizeRaisesEachBatchFile(t *testing.T) {
+	files := []FileUpload{
+		{FilePath: writeTestFile(t, "small.bin", testData(MinimumChunkSize+10)), Key: "small.bin"},
+		{FilePath: writeTestFile(t, "large.bin", testData(3*MinimumChunkSize)), Key: "large.bin"},
+	}
+
+	cfg := UploadConfiguration{Bucket: "bucket", ChunkSize: MinimumChunkSize, MaxParts: 2}
+
+	t.Run("off", func(t *testing.T) {
+		batch := newTestUploader(newFakeS3()).UploadFiles(context.Background(), cfg, files)
+
+		if len(batch.Failed) != 1 || batch.Failed[0].Key != "large.bin" {
+			t.Errorf("got %d failed files, want only large.bin to need too many parts", len(batch.Failed))
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		autoCfg := cfg
+		autoCfg.AutoChunkSize = true
+
+		batch := newTestUploader(newFakeS3()).UploadFiles(context.Background(), autoCfg, files)
+
+		if len(batch.Failed) > 0 {
+			t.Fatalf("upload of %s failed: %v", batch.Failed[0].Key, batch.Failed[0].Err)
+		}
+
+		for _, file := range batch.Files {
+			if file.Result.PartCount != 2 || (file.Key == "small.bin") != (file.Result.ChunkSize == MinimumChunkSize) {
+				t.Errorf("%s was sent in %d parts of %d bytes, want 2 parts raised only for large.bin", file.Key, file.Result.PartCount, file.Result.ChunkSize)
+			}
+		}
+	})
+}
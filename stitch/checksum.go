@@ -0,0 +1,146 @@
+package stitch
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ChecksumAlgorithms are the per-part checksums S3 can validate on upload.
+var ChecksumAlgorithms = []types.ChecksumAlgorithm{
+	types.ChecksumAlgorithmCrc32,
+	types.ChecksumAlgorithmCrc32c,
+	types.ChecksumAlgorithmSha1,
+	types.ChecksumAlgorithmSha256,
+}
+
+func ParseChecksumAlgorithm(value string) (types.ChecksumAlgorithm, error) {
+	return parseEnum("checksum algorithm", value, ChecksumAlgorithms)
+}
+
+// ChecksumMode chooses how the checksum of each part reaches S3.
+type ChecksumMode string
+
+const (
+	// ChecksumModePrecomputed hashes each part before sending it and sends
+	// the checksum as a header. It is the default.
+	ChecksumModePrecomputed ChecksumMode = "precomputed"
+
+	// ChecksumModeTrailer has the SDK hash each part while sending it and
+	// send the checksum in an x-amz-trailer, so the part isn't read twice.
+	// Trailers need TLS, so over plain HTTP the SDK hashes the part up front
+	// instead.
+	ChecksumModeTrailer ChecksumMode = "trailer"
+)
+
+// ChecksumModes are the supported values of UploadConfiguration.ChecksumMode.
+var ChecksumModes = []ChecksumMode{
+	ChecksumModePrecomputed,
+	ChecksumModeTrailer,
+}
+
+func ParseChecksumMode(value string) (ChecksumMode, error) {
+	return parseEnum("checksum mode", value, ChecksumModes)
+}
+
+// partChecksum returns the base64 encoded checksum of data in the format S3
+// expects in the x-amz-checksum-* headers
+func partChecksum(algorithm types.ChecksumAlgorithm, data []byte) string {
+	var h hash.Hash
+
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		h = crc32.NewIEEE()
+	case types.ChecksumAlgorithmCrc32c:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case types.ChecksumAlgorithmSha1:
+		h = sha1.New()
+	case types.ChecksumAlgorithmSha256:
+		h = sha256.New()
+	default:
+		return ""
+	}
+
+	h.Write(data)
+
+	if crc, ok := h.(hash.Hash32); ok {
+		return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// contentMD5 returns the base64 encoded MD5 of data for the Content-MD5 header
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func setPartChecksum(input *s3.UploadPartInput, algorithm types.ChecksumAlgorithm, checksum *string) {
+	input.ChecksumAlgorithm = algorithm
+
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		input.ChecksumCRC32 = checksum
+	case types.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = checksum
+	case types.ChecksumAlgorithmSha1:
+		input.ChecksumSHA1 = checksum
+	case types.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = checksum
+	}
+}
+
+func setCompletedChecksum(part *types.CompletedPart, algorithm types.ChecksumAlgorithm, checksum *string) {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		part.ChecksumCRC32 = checksum
+	case types.ChecksumAlgorithmCrc32c:
+		part.ChecksumCRC32C = checksum
+	case types.ChecksumAlgorithmSha1:
+		part.ChecksumSHA1 = checksum
+	case types.ChecksumAlgorithmSha256:
+		part.ChecksumSHA256 = checksum
+	}
+}
+
+// uploadedChecksum returns the checksum S3 computed for an uploaded part,
+// which is how a trailing checksum's value is learned
+func uploadedChecksum(resp *s3.UploadPartOutput, algorithm types.ChecksumAlgorithm) *string {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		return resp.ChecksumCRC32
+	case types.ChecksumAlgorithmCrc32c:
+		return resp.ChecksumCRC32C
+	case types.ChecksumAlgorithmSha1:
+		return resp.ChecksumSHA1
+	case types.ChecksumAlgorithmSha256:
+		return resp.ChecksumSHA256
+	}
+
+	return nil
+}
+
+// existingChecksum returns the checksum S3 stored for a part that was
+// uploaded before a resume
+func existingChecksum(part types.Part, algorithm types.ChecksumAlgorithm) *string {
+	switch algorithm {
+	case types.ChecksumAlgorithmCrc32:
+		return part.ChecksumCRC32
+	case types.ChecksumAlgorithmCrc32c:
+		return part.ChecksumCRC32C
+	case types.ChecksumAlgorithmSha1:
+		return part.ChecksumSHA1
+	case types.ChecksumAlgorithmSha256:
+		return part.ChecksumSHA256
+	}
+
+	return nil
+}
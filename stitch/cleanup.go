@@ -0,0 +1,81 @@
+package stitch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// StaleUploads lists the multipart uploads in bucket under keyPrefix that were
+// started more than olderThan ago, following every page of results.
+func (u *Uploader) StaleUploads(ctx context.Context, bucket string, keyPrefix string, olderThan time.Duration) ([]types.MultipartUpload, error) {
+	client, ok := u.Client.(s3.ListMultipartUploadsAPIClient)
+
+	if !ok {
+		return nil, errors.New("cannot list uploads: client does not implement ListMultipartUploads")
+	}
+
+	paginator := s3.NewListMultipartUploadsPaginator(client, &s3.ListMultipartUploadsInput{
+		Bucket: &bucket,
+		Prefix: optionalString(keyPrefix),
+	})
+
+	cutoff := time.Now().Add(-olderThan)
+	var stale []types.MultipartUpload
+
+	for paginator.HasMorePages() {
+		reqCtx, cancel := u.requestContext(ctx)
+		page, err := paginator.NextPage(reqCtx)
+		cancel()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range page.Uploads {
+			if upload.Initiated != nil && upload.Initiated.Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+	}
+
+	return stale, nil
+}
+
+// AbortStaleUpload aborts an upload returned by StaleUploads, retrying
+// transient failures like a part upload. An upload that no longer exists
+// counts as aborted.
+func (u *Uploader) AbortStaleUpload(ctx context.Context, bucket string, upload types.MultipartUpload) error {
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := u.requestContext(ctx)
+		_, err := u.Client.AbortMultipartUpload(reqCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   &bucket,
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		cancel()
+
+		var apiErr smithy.APIError
+		if err == nil || errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+			return nil
+		}
+
+		if attempt >= u.MaxRetries || ctx.Err() != nil || !(isRetryable(err) || timedOut(ctx, err)) {
+			return fmt.Errorf("failed to abort multipart upload %s: %w", aws.ToString(upload.UploadId), err)
+		}
+
+		delay := backoff(u.RetryBaseDelay, attempt)
+		u.logger().Warn("Retrying abort", "key", aws.ToString(upload.Key), "uploadId", aws.ToString(upload.UploadId),
+			"delay", delay, "attempt", attempt+1, "maxRetries", u.MaxRetries, "error", err)
+
+		if !u.sleep(ctx, delay) {
+			return ctx.Err()
+		}
+	}
+}
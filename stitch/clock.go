@@ -0,0 +1,44 @@
+package stitch
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the time source for retry delays and part timings, so tests can
+// replace it with one that moves time forward instantly.
+type Clock interface {
+	Now() time.Time
+
+	// After sends the time on the channel once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (u *Uploader) clock() Clock {
+	if u.Clock == nil {
+		return realClock{}
+	}
+
+	return u.Clock
+}
+
+// sleep waits out a retry delay on the clock, returning false if ctx was
+// cancelled first
+func (u *Uploader) sleep(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-u.clock().After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
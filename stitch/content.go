@@ -0,0 +1,64 @@
+package stitch
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// resolveContentType returns the configured content type, detecting one when
+// it wasn't set
+func resolveContentType(cfg UploadConfiguration, src *source) (string, error) {
+	if cfg.ContentType != "" {
+		return cfg.ContentType, nil
+	}
+
+	// A stream has no file name, so the key's extension is used, less the
+	// .gz a compressed upload adds
+	name := cfg.FilePath
+	if src.stream {
+		name = cfg.Key
+		if cfg.Gzip {
+			name = strings.TrimSuffix(name, ".gz")
+		}
+	}
+
+	return detectContentType(name, src)
+}
+
+// detectContentType guesses the MIME type from the name's extension, falling
+// back to sniffing the first 512 bytes of the source when it is unknown. The
+// source is left positioned where it was.
+func detectContentType(name string, src *source) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	var header []byte
+
+	switch r := src.r.(type) {
+	case interface{ Peek(int) ([]byte, error) }:
+		peeked, err := r.Peek(sniffLen)
+
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read input: %v", err)
+		}
+
+		header = peeked
+	case io.ReaderAt:
+		header = make([]byte, sniffLen)
+
+		n, err := r.ReadAt(header, 0)
+
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read file: %v", err)
+		}
+
+		header = header[:n]
+	}
+
+	return http.DetectContentType(header), nil
+}
@@ -0,0 +1,20 @@
+package stitch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// encodeEncryptionContext formats a KMS encryption context the way S3 expects
+// it in x-amz-server-side-encryption-context, base64 encoded JSON
+func encodeEncryptionContext(context map[string]string) *string {
+	if len(context) == 0 {
+		return nil
+	}
+
+	// A map of strings always marshals
+	data, _ := json.Marshal(context)
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	return &encoded
+}
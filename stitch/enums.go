@@ -0,0 +1,56 @@
+package stitch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ServerSideEncryptions are the supported encryption modes, SSE-S3 and SSE-KMS.
+var ServerSideEncryptions = []types.ServerSideEncryption{
+	types.ServerSideEncryptionAes256,
+	types.ServerSideEncryptionAwsKms,
+}
+
+func ParseServerSideEncryption(value string) (types.ServerSideEncryption, error) {
+	return parseEnum("server-side encryption", value, ServerSideEncryptions)
+}
+
+func ParseCannedACL(value string) (types.ObjectCannedACL, error) {
+	return parseEnum("canned ACL", value, types.ObjectCannedACL("").Values())
+}
+
+func ParseStorageClass(value string) (types.StorageClass, error) {
+	return parseEnum("storage class", value, types.StorageClass("").Values())
+}
+
+func ParseObjectLockMode(value string) (types.ObjectLockMode, error) {
+	return parseEnum("object lock mode", value, types.ObjectLockMode("").Values())
+}
+
+func ParseObjectLockLegalHold(value string) (types.ObjectLockLegalHoldStatus, error) {
+	return parseEnum("object lock legal hold status", value, types.ObjectLockLegalHoldStatus("").Values())
+}
+
+// parseEnum matches value case-insensitively against the allowed values of an
+// SDK enum, listing them in the error when nothing matches
+func parseEnum[T ~string](name string, value string, values []T) (T, error) {
+	for _, v := range values {
+		if strings.EqualFold(value, string(v)) {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported %s %q, valid options are: %s", name, value, joinValues(values))
+}
+
+func joinValues[T ~string](values []T) string {
+	names := make([]string, len(values))
+
+	for i, value := range values {
+		names[i] = string(value)
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,98 @@
+package stitch
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MultipartETag computes the ETag S3 gives the object uploaded from the file
+// at path in parts of chunkSize, so the upload can be checked without
+// downloading it: the MD5 of the parts' MD5s joined together, then a dash and
+// the part count. An empty file has no parts, and gets the plain MD5 of its
+// content. The ETag is returned without the quotes S3 puts around it. Files
+// that may be sent with a single PutObject are better checked with
+// ObjectETag.
+//
+// Objects encrypted with SSE-KMS or SSE-C have ETags that aren't derived from
+// their content, so only those stored in plain or with SSE-S3 will match.
+func MultipartETag(path string, chunkSize int64) (string, error) {
+	if chunkSize <= 0 {
+		return "", errors.New("chunk size must be positive")
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	defer f.Close()
+
+	var partSums []byte
+	var offset int64
+	parts := 0
+
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, chunkSize)
+
+		if n > 0 {
+			partSums = h.Sum(partSums)
+			parts++
+		}
+
+		offset += n
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to read file at byte offset %d: %v", offset, err)
+		}
+	}
+
+	if parts == 0 {
+		sum := md5.Sum(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	sum := md5.Sum(partSums)
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+// ObjectETag computes the ETag Upload gives the object from cfg.FilePath: the
+// plain MD5 of its content when PutsObject sends the file in one request, or
+// its MultipartETag at the chunk size it is split by otherwise.
+func (u *Uploader) ObjectETag(cfg UploadConfiguration) (string, error) {
+	info, err := os.Stat(cfg.FilePath)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	if !u.PutsObject(cfg, info.Size()) {
+		return MultipartETag(cfg.FilePath, cfg.EffectiveChunkSize(info.Size()))
+	}
+
+	f, err := os.Open(cfg.FilePath)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	defer f.Close()
+
+	h := md5.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
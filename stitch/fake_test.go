@@ -0,0 +1,399 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3 is an in-memory S3 that records every call it is sent, keeps the
+// parts of each multipart upload and assembles them into an object on
+// completion. Parts can be made to fail with failPart.
+type fakeS3 struct {
+	mu sync.Mutex
+
+	// retainBodies keeps each part's body unread until the upload is done,
+	// as a client that reads the body after UploadPart returns would
+	retainBodies bool
+
+	// partDelay holds every UploadPart open this long, so parts overlap
+	partDelay time.Duration
+
+	// completeErr fails every CompleteMultipartUpload with it when set
+	completeErr error
+
+	calls    []string
+	uploads  map[string]*fakeUpload
+	objects  map[string][]byte
+	etags    map[string]string
+	failures map[int32]*partFailure
+	retained map[int32]io.Reader
+	nextId   int
+
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int32][]byte
+}
+
+type partFailure struct {
+	// remaining counts the attempts still to fail, with a negative count
+	// failing every attempt
+	remaining int
+	err       error
+}
+
+var _ S3MultipartAPI = (*fakeS3)(nil)
+var _ s3.ListPartsAPIClient = (*fakeS3)(nil)
+var _ putObjectAPI = (*fakeS3)(nil)
+var _ headObjectAPI = (*fakeS3)(nil)
+var _ getObjectAPI = (*fakeS3)(nil)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		uploads:  make(map[string]*fakeUpload),
+		objects:  make(map[string][]byte),
+		etags:    make(map[string]string),
+		failures: make(map[int32]*partFailure),
+		retained: make(map[int32]io.Reader),
+	}
+}
+
+// apiError is the error S3 responds with for code
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code}
+}
+
+// failPart has UploadPart fail part with err for the next times attempts, or
+// for every attempt when times is negative
+func (f *fakeS3) failPart(part int32, times int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[part] = &partFailure{remaining: times, err: err}
+}
+
+func (f *fakeS3) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, call)
+}
+
+// recorded returns the names of the calls made, without their arguments
+func (f *fakeS3) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.calls)
+}
+
+func (f *fakeS3) count(call string) int {
+	n := 0
+
+	for _, c := range f.recorded() {
+		if c == call {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// openUploads is how many multipart uploads were neither completed nor
+// aborted
+func (f *fakeS3) openUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.uploads)
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.record("CreateMultipartUpload")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextId++
+	uploadId := "upload-" + strconv.Itoa(f.nextId)
+	f.uploads[uploadId] = &fakeUpload{key: aws.ToString(params.Key), parts: make(map[int32][]byte)}
+
+	return &s3.CreateMultipartUploadOutput{UploadId: &uploadId}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	f.record("UploadPart")
+
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+
+	for seen := f.maxInFlight.Load(); n > seen && !f.maxInFlight.CompareAndSwap(seen, n); {
+		seen = f.maxInFlight.Load()
+	}
+
+	if f.partDelay > 0 {
+		time.Sleep(f.partDelay)
+	}
+
+	partNum := aws.ToInt32(params.PartNumber)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload, ok := f.uploads[aws.ToString(params.UploadId)]
+
+	if !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+
+	if failure, ok := f.failures[partNum]; ok && failure.remaining != 0 {
+		failure.remaining--
+		return nil, failure.err
+	}
+
+	if f.retainBodies {
+		f.retained[partNum] = params.Body
+		upload.parts[partNum] = nil
+		return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"part-%d"`, partNum))}, nil
+	}
+
+	data, err := io.ReadAll(params.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	upload.parts[partNum] = data
+
+	return &s3.UploadPartOutput{ETag: aws.String(etagOf(data))}, nil
+}
+
+// readRetained reads the bodies kept by retainBodies, as the parts they
+// were sent for still hold them
+func (f *fakeS3) readRetained() (map[int32][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := make(map[int32][]byte, len(f.retained))
+
+	for partNum, body := range f.retained {
+		data, err := io.ReadAll(body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		parts[partNum] = data
+	}
+
+	return parts, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.record("CompleteMultipartUpload")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.completeErr != nil {
+		return nil, f.completeErr
+	}
+
+	uploadId := aws.ToString(params.UploadId)
+	upload, ok := f.uploads[uploadId]
+
+	if !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+
+	parts := params.MultipartUpload.Parts
+	var object []byte
+
+	for i, part := range parts {
+		partNum := aws.ToInt32(part.PartNumber)
+
+		if i > 0 && partNum <= aws.ToInt32(parts[i-1].PartNumber) {
+			return nil, apiError("InvalidPartOrder")
+		}
+
+		data, ok := upload.parts[partNum]
+
+		if !ok {
+			return nil, apiError("InvalidPart")
+		}
+
+		if i < len(parts)-1 && len(data) < MinimumChunkSize && !f.retainBodies {
+			return nil, apiError("EntityTooSmall")
+		}
+
+		object = append(object, data...)
+	}
+
+	etag := fmt.Sprintf(`"%s-%d"`, etagOf(object)[1:33], len(parts))
+	f.objects[upload.key] = object
+	f.etags[upload.key] = etag
+	delete(f.uploads, uploadId)
+
+	return &s3.CompleteMultipartUploadOutput{ETag: &etag, Key: &upload.key}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.record("AbortMultipartUpload")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	uploadId := aws.ToString(params.UploadId)
+
+	if _, ok := f.uploads[uploadId]; !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+
+	delete(f.uploads, uploadId)
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.record("ListParts")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	upload, ok := f.uploads[aws.ToString(params.UploadId)]
+
+	if !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+
+	var parts []types.Part
+
+	for partNum, data := range upload.parts {
+		parts = append(parts, types.Part{
+			PartNumber: aws.Int32(partNum),
+			Size:       aws.Int64(int64(len(data))),
+			ETag:       aws.String(etagOf(data)),
+		})
+	}
+
+	slices.SortFunc(parts, func(a, b types.Part) int {
+		return int(*a.PartNumber - *b.PartNumber)
+	})
+
+	return &s3.ListPartsOutput{Parts: parts, IsTruncated: aws.Bool(false)}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.record("PutObject")
+
+	data, err := io.ReadAll(params.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[aws.ToString(params.Key)] = data
+	f.etags[aws.ToString(params.Key)] = etagOf(data)
+
+	return &s3.PutObjectOutput{ETag: aws.String(etagOf(data))}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.record("HeadObject")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := aws.ToString(params.Key)
+	data, ok := f.objects[key]
+
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), ETag: aws.String(f.etags[key])}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.record("GetObject")
+
+	data, ok := f.object(aws.ToString(params.Key))
+
+	if !ok {
+		return nil, apiError("NoSuchKey")
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// testData is size bytes that differ from one part to the next, so parts
+// that are swapped or overwritten don't go unnoticed
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rng := rand.New(rand.NewPCG(uint64(size), 1))
+
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+
+	return data
+}
+
+// writeTestFile writes data to a file in the test's temporary directory and
+// returns its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// newTestUploader uploads to client without waiting between retries
+func newTestUploader(client S3MultipartAPI) *Uploader {
+	u := NewUploader(client)
+	u.RetryBaseDelay = 0
+
+	return u
+}
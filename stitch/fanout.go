@@ -0,0 +1,205 @@
+package stitch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Destination is one of the objects UploadFanOut writes
+type Destination struct {
+	Bucket string
+	Key    string
+
+	// Client, when set, is used for this destination instead of
+	// Uploader.Client, for example for a bucket in another region
+	Client S3MultipartAPI
+}
+
+// DestinationResult is the outcome for one destination of UploadFanOut. Err
+// is set when the destination failed, otherwise Result describes the upload.
+type DestinationResult struct {
+	Destination
+
+	Result *UploadResult
+	Err    error
+}
+
+// errNoDestinations stops reading the source once every destination failed
+var errNoDestinations = errors.New("every destination failed")
+
+// UploadFanOut reads cfg.FilePath once and uploads it to every destination
+// at the same time, each with a multipart upload of its own. cfg.Bucket and
+// cfg.Key are ignored. Without bestEffort the first destination to fail
+// cancels the others, whose uploads are aborted; with it the others carry on
+// and only the failed one is aborted. The returned error wraps the first
+// failure.
+//
+// Each destination runs its own Concurrency workers, buffers, and MaxRate,
+// and reading keeps pace with the slowest one. Progress, ProgressFunc, and
+// PartFunc describe a single upload and aren't used.
+func (u *Uploader) UploadFanOut(ctx context.Context, cfg UploadConfiguration, dests []Destination, bestEffort bool) ([]DestinationResult, error) {
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("%w: at least one destination must be provided", ErrInvalidConfiguration)
+	}
+
+	// Every destination starts its own upload from the one read
+	if cfg.UploadId != "" || cfg.SkipExisting || cfg.firstPart() > 1 {
+		return nil, fmt.Errorf("%w: a fanned out upload can't resume, skip existing objects, or start past part 1", ErrInvalidConfiguration)
+	}
+
+	for _, dest := range dests {
+		destCfg := cfg
+		destCfg.Bucket, destCfg.Key = dest.Bucket, dest.Key
+
+		if err := u.validate(destCfg); err != nil {
+			return nil, fmt.Errorf("%w: %s/%s: %v", ErrInvalidConfiguration, dest.Bucket, dest.Key, err)
+		}
+	}
+
+	if cfg.FilePath == "" {
+		return nil, fmt.Errorf("%w: a file path must be provided", ErrInvalidConfiguration)
+	}
+
+	src, err := openSource(cfg.FilePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer src.close()
+
+	// The destinations only see a stream, so the type comes from the file
+	contentType, err := resolveContentType(cfg, src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ContentType = contentType
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]DestinationResult, len(dests))
+	writers := make([]*io.PipeWriter, len(dests))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for i, dest := range dests {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+
+		destCfg := cfg
+		destCfg.Bucket, destCfg.Key = dest.Bucket, dest.Key
+
+		uploader := u.destinationUploader(dest)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			result, err := uploader.UploadReader(ctx, destCfg, pr, src.size)
+			results[i] = DestinationResult{Destination: dest, Result: result, Err: err}
+
+			// Unblocks the reader should this destination stop reading early
+			pr.CloseWithError(err)
+
+			if err != nil {
+				u.logger().Warn("Destination failed", "bucket", dest.Bucket, "key", dest.Key, "error", err)
+
+				// The first failure is the cause, the others may only have been
+				// cancelled by it
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to upload to %s/%s: %w", dest.Bucket, dest.Key, err)
+				}
+				mu.Unlock()
+
+				if !bestEffort {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	// 1. Read the source once, writing each chunk to every destination
+	fan := &fanOutWriter{writers: writers, failed: make([]bool, len(writers))}
+	_, readErr := io.Copy(fan, src.r)
+
+	if errors.Is(readErr, errNoDestinations) {
+		readErr = nil
+	}
+
+	for _, pw := range writers {
+		pw.CloseWithError(readErr)
+	}
+
+	wg.Wait()
+
+	return results, firstErr
+}
+
+// destinationUploader returns an uploader with u's settings for one
+// destination, using the destination's client when it has one
+func (u *Uploader) destinationUploader(dest Destination) *Uploader {
+	client := u.Client
+	if dest.Client != nil {
+		client = dest.Client
+	}
+
+	return &Uploader{
+		Client:             client,
+		Concurrency:        u.Concurrency,
+		MaxRetries:         u.MaxRetries,
+		RetryBaseDelay:     u.RetryBaseDelay,
+		PartTimeout:        u.PartTimeout,
+		FileConcurrency:    u.FileConcurrency,
+		MaxRate:            u.MaxRate,
+		MaxMemory:          u.MaxMemory,
+		ReadAhead:          u.ReadAhead,
+		Logger:             u.Logger,
+		Metrics:            u.Metrics,
+		Tracer:             u.Tracer,
+		Timing:             u.Timing,
+		Pause:              u.Pause,
+		RefreshCredentials: u.RefreshCredentials,
+	}
+}
+
+// fanOutWriter writes to every destination that hasn't failed, so one
+// failing doesn't hold up the rest
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	written := false
+
+	for i, pw := range w.writers {
+		if w.failed[i] {
+			continue
+		}
+
+		if _, err := pw.Write(p); err != nil {
+			w.failed[i] = true
+			continue
+		}
+
+		written = true
+	}
+
+	if !written {
+		return 0, errNoDestinations
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,36 @@
+package stitch
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipSource compresses src as it is read. The compressed size isn't known
+// until the end, so the result is a stream whose chunks are filled like any
+// other. Closing it stops the compression, while src is still closed by its
+// owner.
+func gzipSource(src *source) *source {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gz := gzip.NewWriter(pw)
+
+		_, err := io.Copy(gz, src.r)
+
+		if err == nil {
+			err = gz.Close()
+		}
+
+		if err != nil {
+			err = fmt.Errorf("failed to compress input: %w", err)
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	compressed := readerSource(pr, -1)
+	compressed.close = pr.Close
+
+	return compressed
+}
@@ -0,0 +1,60 @@
+package stitch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestGzipBatchRoundTrip(t *testing.T) {
+	small := bytes.Repeat([]byte("a small, very compressible text file\n"), 100)
+	// Random bytes barely compress, so this stays a multipart upload
+	large := testData(3 * MinimumChunkSize)
+
+	files := []FileUpload{
+		{FilePath: writeTestFile(t, "small.txt", small), Key: "small.txt.gz"},
+		{FilePath: writeTestFile(t, "large.bin", large), Key: "large.bin.gz"},
+	}
+
+	client := newFakeS3()
+	u := newTestUploader(client)
+
+	batch := u.UploadFiles(context.Background(), UploadConfiguration{Bucket: "bucket", ChunkSize: MinimumChunkSize, Gzip: true}, files)
+
+	if len(batch.Failed) > 0 {
+		t.Fatalf("upload failed: %v", batch.Failed[0].Err)
+	}
+
+	for _, want := range []struct {
+		key  string
+		data []byte
+	}{{"small.txt.gz", small}, {"large.bin.gz", large}} {
+		object, ok := client.object(want.key)
+
+		if !ok {
+			t.Fatalf("%s wasn't uploaded", want.key)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(object))
+
+		if err != nil {
+			t.Fatalf("%s isn't gzip compressed: %v", want.key, err)
+		}
+
+		decompressed, err := io.ReadAll(gz)
+
+		if err != nil {
+			t.Fatalf("failed to decompress %s: %v", want.key, err)
+		}
+
+		if !bytes.Equal(decompressed, want.data) {
+			t.Errorf("%s doesn't decompress to the file", want.key)
+		}
+	}
+
+	if client.count("PutObject") != 0 || client.count("CompleteMultipartUpload") != 2 {
+		t.Errorf("calls %v, want both files compressed through a multipart upload", client.recorded())
+	}
+}
@@ -0,0 +1,273 @@
+//go:build integration
+
+package stitch
+
+// The integration tests upload through the real code path to an S3
+// compatible endpoint, such as the MinIO started by `task minio:start`, and
+// are run with `task test:integration`. STITCH_INTEGRATION_ENDPOINT names the
+// endpoint, with credentials from the default chain, and the tests are
+// skipped without it. Each test creates a bucket of its own and removes it
+// when done.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func integrationClient(t *testing.T) *s3.Client {
+	t.Helper()
+
+	endpoint := os.Getenv("STITCH_INTEGRATION_ENDPOINT")
+
+	if endpoint == "" {
+		t.Skip("STITCH_INTEGRATION_ENDPOINT is not set")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+
+	if err != nil {
+		t.Fatalf("failed to load AWS config: %v", err)
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = true
+	})
+}
+
+// integrationBucket creates an empty bucket for the test, removed along with
+// everything left in it once the test is done
+func integrationBucket(t *testing.T, client *s3.Client) string {
+	t.Helper()
+
+	ctx := context.Background()
+	bucket := fmt.Sprintf("stitch-it-%d", time.Now().UnixNano())
+
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		t.Fatalf("failed to create bucket %s: %v", bucket, err)
+	}
+
+	t.Cleanup(func() {
+		uploads, err := client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: &bucket})
+
+		if err == nil {
+			for _, upload := range uploads.Uploads {
+				client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: &bucket, Key: upload.Key, UploadId: upload.UploadId})
+			}
+		}
+
+		objects, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: &bucket})
+
+		if err == nil {
+			for _, object := range objects.Contents {
+				client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &bucket, Key: object.Key})
+			}
+		}
+
+		if _, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: &bucket}); err != nil {
+			t.Logf("failed to remove bucket %s: %v", bucket, err)
+		}
+	})
+
+	return bucket
+}
+
+func download(t *testing.T, client *s3.Client, bucket string, key string) []byte {
+	t.Helper()
+
+	resp, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+
+	if err != nil {
+		t.Fatalf("failed to download %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatalf("failed to download %s: %v", key, err)
+	}
+
+	return data
+}
+
+// openUploadsFor lists the multipart uploads of key that are still open
+func openUploadsFor(t *testing.T, client *s3.Client, bucket string, key string) []types.MultipartUpload {
+	t.Helper()
+
+	resp, err := client.ListMultipartUploads(context.Background(), &s3.ListMultipartUploadsInput{Bucket: &bucket, Prefix: &key})
+
+	if err != nil {
+		t.Fatalf("failed to list multipart uploads: %v", err)
+	}
+
+	return resp.Uploads
+}
+
+// partFailingClient sends every request to S3 except the parts numbered
+// failPart, which fail as if access were denied, counting the parts sent
+type partFailingClient struct {
+	*s3.Client
+
+	failPart int32
+	sent     atomic.Int32
+}
+
+func (c *partFailingClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if aws.ToInt32(params.PartNumber) == c.failPart {
+		return nil, apiError("AccessDenied")
+	}
+
+	c.sent.Add(1)
+
+	return c.Client.UploadPart(ctx, params, optFns...)
+}
+
+func TestIntegrationRoundTrip(t *testing.T) {
+	client := integrationClient(t)
+	bucket := integrationBucket(t, client)
+
+	data := testData(3*MinimumChunkSize + 4321)
+	path := writeTestFile(t, "data.bin", data)
+
+	u := NewUploader(client)
+	cfg := UploadConfiguration{Bucket: bucket, Key: "round-trip.bin", FilePath: path, ChunkSize: MinimumChunkSize, Verify: true}
+
+	result, err := u.Upload(context.Background(), cfg)
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if result.PartCount != 4 {
+		t.Errorf("uploaded %d parts, want 4", result.PartCount)
+	}
+
+	if !bytes.Equal(download(t, client, bucket, cfg.Key), data) {
+		t.Error("downloaded object doesn't match the file")
+	}
+
+	etag, err := MultipartETag(path, cfg.ChunkSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Trim(result.ETag, `"`); got != etag {
+		t.Errorf("object ETag %s, want %s as computed locally", got, etag)
+	}
+}
+
+func TestIntegrationChecksums(t *testing.T) {
+	client := integrationClient(t)
+	bucket := integrationBucket(t, client)
+
+	data := testData(2*MinimumChunkSize + 99)
+	path := writeTestFile(t, "data.bin", data)
+
+	for _, mode := range ChecksumModes {
+		t.Run(string(mode), func(t *testing.T) {
+			u := NewUploader(client)
+			cfg := UploadConfiguration{
+				Bucket:            bucket,
+				Key:               "checksum-" + string(mode) + ".bin",
+				FilePath:          path,
+				ChunkSize:         MinimumChunkSize,
+				ChecksumAlgorithm: types.ChecksumAlgorithmCrc32c,
+				ChecksumMode:      mode,
+				Verify:            true,
+			}
+
+			if _, err := u.Upload(context.Background(), cfg); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			if !bytes.Equal(download(t, client, bucket, cfg.Key), data) {
+				t.Error("downloaded object doesn't match the file")
+			}
+		})
+	}
+}
+
+func TestIntegrationAbortsOnError(t *testing.T) {
+	client := integrationClient(t)
+	bucket := integrationBucket(t, client)
+
+	path := writeTestFile(t, "data.bin", testData(4*MinimumChunkSize))
+
+	u := NewUploader(&partFailingClient{Client: client, failPart: 2})
+	cfg := UploadConfiguration{Bucket: bucket, Key: "aborted.bin", FilePath: path, ChunkSize: MinimumChunkSize}
+
+	if _, err := u.Upload(context.Background(), cfg); err == nil {
+		t.Fatal("upload succeeded despite a failing part")
+	}
+
+	if uploads := openUploadsFor(t, client, bucket, cfg.Key); len(uploads) > 0 {
+		t.Errorf("failed upload left %d multipart uploads open", len(uploads))
+	}
+}
+
+func TestIntegrationResume(t *testing.T) {
+	client := integrationClient(t)
+	bucket := integrationBucket(t, client)
+
+	data := testData(5*MinimumChunkSize + 17)
+	path := writeTestFile(t, "data.bin", data)
+
+	cfg := UploadConfiguration{Bucket: bucket, Key: "resumed.bin", FilePath: path, ChunkSize: MinimumChunkSize, KeepOnFailure: true}
+
+	failing := NewUploader(&partFailingClient{Client: client, failPart: 3})
+	failing.Concurrency = 1
+
+	partial, err := failing.Upload(context.Background(), cfg)
+
+	if err == nil {
+		t.Fatal("upload succeeded despite a failing part")
+	}
+
+	if partial == nil || partial.UploadId == "" {
+		t.Fatal("failed upload wasn't kept to resume")
+	}
+
+	stored, err := NewUploader(client).ListParts(context.Background(), bucket, cfg.Key, partial.UploadId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumeClient := &partFailingClient{Client: client}
+	cfg.UploadId = partial.UploadId
+
+	if _, err := NewUploader(resumeClient).Upload(context.Background(), cfg); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+
+	if sent, want := int(resumeClient.sent.Load()), 6-len(stored); sent != want {
+		t.Errorf("resume sent %d parts, want the %d not stored before", sent, want)
+	}
+
+	if !bytes.Equal(download(t, client, bucket, cfg.Key), data) {
+		t.Error("downloaded object doesn't match the file")
+	}
+
+	if uploads := openUploadsFor(t, client, bucket, cfg.Key); len(uploads) > 0 {
+		t.Errorf("resumed upload left %d multipart uploads open", len(uploads))
+	}
+}
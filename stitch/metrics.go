@@ -0,0 +1,31 @@
+package stitch
+
+import "time"
+
+// Metrics receives part upload events, for example to export them to a
+// monitoring system. Methods are called concurrently from the part workers
+// and must not block.
+type Metrics interface {
+	// PartUploaded is called once a part is stored, with its size and how
+	// long it took including any retries
+	PartUploaded(size int, duration time.Duration)
+	// PartRetried is called before each retry of a part
+	PartRetried()
+	// PartFailed is called when a part gives up after its last attempt
+	PartFailed()
+}
+
+// discardMetrics is used when Uploader.Metrics is nil
+type discardMetrics struct{}
+
+func (discardMetrics) PartUploaded(int, time.Duration) {}
+func (discardMetrics) PartRetried()                    {}
+func (discardMetrics) PartFailed()                     {}
+
+func (u *Uploader) metrics() Metrics {
+	if u.Metrics == nil {
+		return discardMetrics{}
+	}
+
+	return u.Metrics
+}
@@ -0,0 +1,32 @@
+package stitch
+
+import (
+	"errors"
+	"time"
+)
+
+// validateObjectLock checks that retention has both a mode and a date, and
+// that the date hasn't already passed
+func validateObjectLock(cfg UploadConfiguration) error {
+	if cfg.ObjectLockMode != "" {
+		if _, err := ParseObjectLockMode(string(cfg.ObjectLockMode)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ObjectLockLegalHold != "" {
+		if _, err := ParseObjectLockLegalHold(string(cfg.ObjectLockLegalHold)); err != nil {
+			return err
+		}
+	}
+
+	if (cfg.ObjectLockMode == "") != cfg.ObjectLockRetainUntil.IsZero() {
+		return errors.New("an object lock mode and retain-until date must be given together")
+	}
+
+	if !cfg.ObjectLockRetainUntil.IsZero() && !cfg.ObjectLockRetainUntil.After(time.Now()) {
+		return errors.New("the object lock retain-until date must be in the future")
+	}
+
+	return nil
+}
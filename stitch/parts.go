@@ -0,0 +1,513 @@
+package stitch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type partJob struct {
+	partNum int32
+	buffer  *[]byte
+	offset  int64
+	size    int
+	read    time.Duration
+}
+
+// uploadedParts is everything read from the source during an upload
+type uploadedParts struct {
+	parts    []types.CompletedPart
+	checksum []byte
+	size     int64
+	timings  []PartTiming
+
+	// sizes has the size of every part by part number
+	sizes map[int32]int64
+}
+
+// partList collects completed parts in part number order. A source of known
+// size has a slot for each of its parts, so the parts land in order however
+// the workers finish them. Parts past the slots, as from a stream, are kept
+// aside and sorted once at the end.
+type partList struct {
+	first  int32
+	slots  []types.CompletedPart
+	filled int
+	extra  []types.CompletedPart
+}
+
+func newPartList(first int32, count int64) *partList {
+	return &partList{first: first, slots: make([]types.CompletedPart, count)}
+}
+
+func (l *partList) add(part types.CompletedPart) {
+	if i := int64(aws.ToInt32(part.PartNumber) - l.first); i >= 0 && i < int64(len(l.slots)) {
+		l.slots[i] = part
+		l.filled++
+		return
+	}
+
+	l.extra = append(l.extra, part)
+}
+
+// parts returns the parts added so far, leaving out the slots of parts that
+// never completed
+func (l *partList) parts() []types.CompletedPart {
+	parts := l.slots
+
+	if l.filled < len(l.slots) {
+		parts = make([]types.CompletedPart, 0, l.filled+len(l.extra))
+
+		for _, part := range l.slots {
+			if part.PartNumber != nil {
+				parts = append(parts, part)
+			}
+		}
+	}
+
+	if len(l.extra) == 0 {
+		return parts
+	}
+
+	// Every extra part comes after the slots
+	sort.Slice(l.extra, func(i, j int) bool {
+		return *l.extra[i].PartNumber < *l.extra[j].PartNumber
+	})
+
+	return append(parts, l.extra...)
+}
+
+// expectedParts is how many parts the source is split into, or zero when its
+// size isn't known
+func expectedParts(cfg UploadConfiguration, size int64) int64 {
+	if len(cfg.PartSizes) > 0 {
+		return int64(len(cfg.PartSizes))
+	}
+
+	if size <= 0 {
+		return 0
+	}
+
+	return min(PartCount(size, cfg.ChunkSize), cfg.PartLimit())
+}
+
+// uploadParts uploads every part that isn't already in existingParts and
+// returns the completed parts along with the SHA-256 of the whole source. On
+// failure it still returns the parts that made it to S3 and their total size.
+func (u *Uploader) uploadParts(cfg UploadConfiguration, ctx context.Context, src *source, uploadId string, existingParts map[int32]types.Part, budget partBudget) (*uploadedParts, error) {
+	var alreadyUploaded int64
+	for _, part := range existingParts {
+		alreadyUploaded += aws.ToInt64(part.Size)
+	}
+
+	prog := newProgress(u.Progress, u.ProgressFunc, src.size, alreadyUploaded)
+	defer prog.finish()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	partCount := expectedParts(cfg, src.size)
+
+	var (
+		mu             sync.Mutex
+		wg             sync.WaitGroup
+		firstErr       error
+		completedParts = newPartList(cfg.firstPart(), partCount)
+		completedBytes int64
+		timings        []PartTiming
+		sizes          = make(map[int32]int64, partCount)
+	)
+
+	// fail records the first error and cancels the remaining work
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	workers := u.partConcurrency(cfg.ChunkSize)
+	readAhead := u.readAhead(cfg.ChunkSize, workers)
+	buffers := newBufferSlots(workers+readAhead, cfg.ChunkSize)
+
+	limiter := u.rateLimiter()
+
+	// Parts read ahead wait here for a worker
+	jobs := make(chan partJob, readAhead)
+
+	for range workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				if !u.Pause.wait(ctx) {
+					buffers.release()
+					budget.release()
+					return
+				}
+
+				// 2. Upload each part
+				start := u.now()
+				partCtx, span := u.startSpan(ctx, "UploadPart", cfg,
+					attribute.Int("aws.s3.part_number", int(job.partNum)), attribute.Int("stitch.part.size", job.size))
+				spanStart := time.Now()
+
+				part, err := u.uploadSinglePart(partCtx, cfg, limiter, uploadId, job.partNum, (*job.buffer)[:job.size])
+				endPartSpan(span, spanStart, err)
+
+				uploadTime := u.since(start)
+
+				buffers.release()
+				budget.release()
+
+				// A part cut short by cancellation isn't its own failure, the
+				// upload ends with the context's error instead
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+
+				if err != nil {
+					fail(fmt.Errorf("failed to upload part %d: %w", job.partNum, uploadNotFoundError(uploadId, err)))
+					return
+				}
+
+				u.logger().Debug("Uploaded part", "key", cfg.Key, "part", job.partNum, "offset", job.offset,
+					"size", job.size, "etag", aws.ToString(part.ETag))
+				prog.partUploaded(job.partNum, job.size)
+
+				if u.Timing {
+					u.logger().Info("Part timing", "key", cfg.Key, "part", job.partNum, "size", job.size,
+						"read", job.read, "upload", uploadTime)
+				}
+
+				mu.Lock()
+				completedParts.add(part)
+				completedBytes += int64(job.size)
+				sizes[job.partNum] = int64(job.size)
+				if u.Timing {
+					timings = append(timings, PartTiming{PartNumber: job.partNum, Size: job.size, Read: job.read, Upload: uploadTime})
+				}
+				u.partStored(uploadId, part)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	partNum := cfg.firstPart()
+	hash := sha256.New()
+	var size int64
+
+	// Cancellation is checked before every part, so reading stops promptly
+	// rather than whenever the next request notices
+	for ctx.Err() == nil {
+		if part, ok := existingParts[partNum]; ok {
+			// Parts already in S3 are still read through the hash, which also
+			// moves the file offset to the start of the next part
+			if copied, err := io.CopyN(hash, src.r, aws.ToInt64(part.Size)); err != nil {
+				fail(fmt.Errorf("failed to read part %d at byte offset %d: %v", partNum, size+copied, err))
+				break
+			}
+
+			completed := types.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: aws.Int32(partNum),
+			}
+			setCompletedChecksum(&completed, cfg.ChecksumAlgorithm, existingChecksum(part, cfg.ChecksumAlgorithm))
+
+			mu.Lock()
+			completedParts.add(completed)
+			completedBytes += aws.ToInt64(part.Size)
+			sizes[partNum] = aws.ToInt64(part.Size)
+			u.partStored(uploadId, completed)
+			mu.Unlock()
+
+			size += aws.ToInt64(part.Size)
+			partNum++
+			continue
+		}
+
+		buffer, ok := buffers.get(ctx)
+
+		if !ok {
+			break
+		}
+
+		// The batch-wide budget is only taken once the part has a buffer, so
+		// a slot is never held while waiting on this file's own workers
+		if !budget.acquire(ctx) {
+			buffers.release()
+			break
+		}
+
+		readStart := u.now()
+		n, err := src.readChunk(cfg.partBuffer(*buffer, partNum), u.clock())
+		readTime := u.since(readStart)
+
+		if err != nil {
+			buffers.release()
+			budget.release()
+			fail(fmt.Errorf("failed to read part %d at byte offset %d: %v", partNum, size+int64(n), err))
+			break
+		}
+
+		if n == 0 {
+			buffers.release()
+			budget.release()
+			break
+		}
+
+		// Reading a part can take a while, so check again before handing it
+		// to a worker
+		if ctx.Err() != nil {
+			buffers.release()
+			budget.release()
+			break
+		}
+
+		// A stream's length isn't known up front, so the limit is only
+		// reached once it has produced too much data
+		if int64(partNum-cfg.firstPart()) >= cfg.PartLimit() {
+			buffers.release()
+			budget.release()
+			fail(fmt.Errorf("input needs more than %d parts, use a larger chunk size", cfg.PartLimit()))
+			break
+		}
+
+		hash.Write((*buffer)[:n])
+		offset := size
+		size += int64(n)
+
+		select {
+		case jobs <- partJob{partNum: partNum, buffer: buffer, offset: offset, size: n, read: readTime}:
+		case <-ctx.Done():
+			buffers.release()
+			budget.release()
+		}
+
+		partNum++
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	// Workers that stopped early leave parts read ahead behind
+	for range jobs {
+		buffers.release()
+		budget.release()
+	}
+
+	parts := completedParts.parts()
+
+	if firstErr != nil {
+		return &uploadedParts{parts: parts, size: completedBytes}, firstErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return &uploadedParts{parts: parts, size: completedBytes}, err
+	}
+
+	return &uploadedParts{parts: parts, checksum: hash.Sum(nil), size: size, timings: timings, sizes: sizes}, nil
+}
+
+// checkPartSizes makes sure every part but the last reaches the S3 minimum
+// before completing, since S3 would only reject the completion with a bare
+// EntityTooSmall. Parts of unknown size are left to S3.
+func checkPartSizes(parts []types.CompletedPart, sizes map[int32]int64) error {
+	for _, part := range parts[:max(len(parts)-1, 0)] {
+		partNum := aws.ToInt32(part.PartNumber)
+
+		if size, ok := sizes[partNum]; ok && size < MinimumChunkSize {
+			return fmt.Errorf("part %d is %d bytes, below the minimum of %d for every part but the last", partNum, size, MinimumChunkSize)
+		}
+	}
+
+	return nil
+}
+
+// validatePartSizes checks that PartSizes could make a valid upload,
+// leaving their total to be checked against the file
+func validatePartSizes(cfg UploadConfiguration) error {
+	if len(cfg.PartSizes) == 0 {
+		return nil
+	}
+
+	if cfg.UploadId != "" || cfg.firstPart() > 1 {
+		return errors.New("part sizes can't be used to resume an upload or with a start part after 1")
+	}
+
+	if cfg.AdaptiveChunkSize || cfg.Gzip {
+		return errors.New("part sizes can't be combined with an adaptive chunk size or gzip compression")
+	}
+
+	if limit := cfg.PartLimit(); int64(len(cfg.PartSizes)) > limit {
+		return fmt.Errorf("%d part sizes are more than the limit of %d parts", len(cfg.PartSizes), limit)
+	}
+
+	for i, size := range cfg.PartSizes {
+		if size < 1 || size > MaximumChunkSize {
+			return fmt.Errorf("part %d must be between 1 and %d bytes, got %d", i+1, MaximumChunkSize, size)
+		}
+
+		if i < len(cfg.PartSizes)-1 && size < MinimumChunkSize {
+			return fmt.Errorf("part %d is %d bytes, below the minimum of %d for every part but the last", i+1, size, MinimumChunkSize)
+		}
+	}
+
+	return nil
+}
+
+// CheckPartSizesTotal makes sure PartSizes, when set, cover exactly a source
+// of size bytes, as the upload does before sending anything.
+func (cfg UploadConfiguration) CheckPartSizesTotal(size int64) error {
+	if len(cfg.PartSizes) == 0 {
+		return nil
+	}
+
+	if size < 0 {
+		return fmt.Errorf("%w: part sizes need a source of known size", ErrInvalidConfiguration)
+	}
+
+	var total int64
+	for _, partSize := range cfg.PartSizes {
+		total += partSize
+	}
+
+	if total != size {
+		return fmt.Errorf("%w: part sizes add up to %d bytes but the source is %d", ErrInvalidConfiguration, total, size)
+	}
+
+	return nil
+}
+
+// partBuffer is the part of buffer that part partNum is read into, all of it
+// unless PartSizes gives the part a size of its own
+func (cfg UploadConfiguration) partBuffer(buffer []byte, partNum int32) []byte {
+	if i := int(partNum - cfg.firstPart()); i < len(cfg.PartSizes) {
+		return buffer[:cfg.PartSizes[i]]
+	}
+
+	return buffer
+}
+
+// finalPartSize is the size of the last of the sorted parts, or zero when it
+// isn't known
+func finalPartSize(parts []types.CompletedPart, sizes map[int32]int64) int64 {
+	if len(parts) == 0 {
+		return 0
+	}
+
+	return sizes[aws.ToInt32(parts[len(parts)-1].PartNumber)]
+}
+
+// partStored calls PartFunc, with the lock serializing the calls held
+func (u *Uploader) partStored(uploadId string, part types.CompletedPart) {
+	if u.PartFunc != nil {
+		u.PartFunc(uploadId, part)
+	}
+}
+
+// partConcurrency is the number of part workers for chunks of chunkSize,
+// lowered from Concurrency when MaxMemory can't hold a buffer for each
+func (u *Uploader) partConcurrency(chunkSize int64) int {
+	if u.MaxMemory <= 0 || int64(u.Concurrency)*chunkSize <= u.MaxMemory {
+		return u.Concurrency
+	}
+
+	workers := int(max(u.MaxMemory/chunkSize, 1))
+	u.logger().Warn("Reducing concurrency to fit the memory limit",
+		"concurrency", u.Concurrency, "reducedTo", workers, "chunkSize", chunkSize, "maxMemory", u.MaxMemory)
+
+	return workers
+}
+
+// readAhead is the number of parts read ahead of workers busy with chunks of
+// chunkSize, lowered from ReadAhead when MaxMemory can't hold their buffers
+// as well as the workers'
+func (u *Uploader) readAhead(chunkSize int64, workers int) int {
+	if u.MaxMemory <= 0 || int64(workers+u.ReadAhead)*chunkSize <= u.MaxMemory {
+		return u.ReadAhead
+	}
+
+	readAhead := int(max(u.MaxMemory/chunkSize-int64(workers), 0))
+	u.logger().Warn("Reducing read ahead to fit the memory limit",
+		"readAhead", u.ReadAhead, "reducedTo", readAhead, "chunkSize", chunkSize, "maxMemory", u.MaxMemory)
+
+	return readAhead
+}
+
+// partBudget is a semaphore shared by every file of an UploadFiles batch so
+// Concurrency bounds the requests in flight across all of them. A nil budget
+// leaves each upload limited only by its own workers.
+type partBudget chan struct{}
+
+func (b partBudget) acquire(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+
+	select {
+	case b <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b partBudget) release() {
+	if b != nil {
+		<-b
+	}
+}
+
+// bufferSlots limits the chunk buffers in use to limit at a time. Each part
+// is read into a new buffer rather than one recycled: the client may still
+// hold the part's body after UploadPart returns, as a client that keeps and
+// reads it later does, so reading the next part into it would change what
+// that body holds. The garbage collector frees it once nothing refers to it.
+type bufferSlots struct {
+	// slots is a semaphore with one token per buffer in use, so get blocks
+	// the reader until a worker is done with a part instead of letting it
+	// read further ahead
+	slots chan struct{}
+	size  int64
+}
+
+func newBufferSlots(limit int, size int64) *bufferSlots {
+	return &bufferSlots{
+		slots: make(chan struct{}, limit),
+		size:  size,
+	}
+}
+
+// get waits for a free slot and returns a new buffer for it, or false if ctx
+// is done first
+func (s *bufferSlots) get(ctx context.Context) (*[]byte, bool) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	buffer := make([]byte, s.size)
+	return &buffer, true
+}
+
+// release frees the slot of a buffer that is done with, letting the reader
+// take another
+func (s *bufferSlots) release() {
+	<-s.slots
+}
@@ -0,0 +1,169 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestRetainedPartBodiesKeepTheirBytes(t *testing.T) {
+	data := testData(6*MinimumChunkSize + 77)
+	path := writeTestFile(t, "data.bin", data)
+
+	client := newFakeS3()
+	client.retainBodies = true
+	u := newTestUploader(client)
+	u.Concurrency = 2
+
+	cfg := UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize}
+
+	if _, err := u.Upload(context.Background(), cfg); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	// Only read now, after every buffer could have been used for a later part
+	parts, err := client.readRetained()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 7 {
+		t.Fatalf("got %d parts, want 7", len(parts))
+	}
+
+	for partNum, body := range parts {
+		start := int64(partNum-1) * cfg.ChunkSize
+		end := min(start+cfg.ChunkSize, int64(len(data)))
+
+		if !bytes.Equal(body, data[start:end]) {
+			t.Errorf("part %d holds other bytes than the file's at %d-%d", partNum, start, end)
+		}
+	}
+}
+
+func TestPartSizesSetEveryPart(t *testing.T) {
+	partSizes := []int64{MinimumChunkSize + 1, 2 * MinimumChunkSize, MinimumChunkSize, 10}
+	var size int64
+	for _, partSize := range partSizes {
+		size += partSize
+	}
+
+	data := testData(int(size))
+	path := writeTestFile(t, "data.bin", data)
+
+	client := newFakeS3()
+	u := newTestUploader(client)
+
+	var mu sync.Mutex
+	sent := make([]int64, len(partSizes))
+	u.ProgressFunc = func(partNum int32, bytesThisPart int, totalUploaded int64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent[partNum-1] = int64(bytesThisPart)
+	}
+
+	result, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize, PartSizes: partSizes})
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if !slices.Equal(sent, partSizes) {
+		t.Errorf("sent parts of %v bytes, want %v", sent, partSizes)
+	}
+
+	if result.FinalPartSize != 10 {
+		t.Errorf("final part is %d bytes, want 10", result.FinalPartSize)
+	}
+
+	if object, _ := client.object("key"); !bytes.Equal(object, data) {
+		t.Error("object doesn't match the file")
+	}
+}
+
+func TestPartSizesRejected(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(2*MinimumChunkSize))
+
+	for _, tc := range []struct {
+		name      string
+		partSizes []int64
+	}{
+		{"short of the file", []int64{MinimumChunkSize, MinimumChunkSize - 1}},
+		{"past the file", []int64{MinimumChunkSize, MinimumChunkSize + 1}},
+		{"non-final part below the minimum", []int64{MinimumChunkSize - 1, MinimumChunkSize + 1}},
+		{"empty part", []int64{2 * MinimumChunkSize, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeS3()
+			u := newTestUploader(client)
+
+			_, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize, PartSizes: tc.partSizes})
+
+			if !errors.Is(err, ErrInvalidConfiguration) {
+				t.Fatalf("got error %v, want an invalid configuration", err)
+			}
+
+			if calls := client.recorded(); len(calls) > 0 {
+				t.Errorf("sent %v before rejecting the part sizes", calls)
+			}
+		})
+	}
+}
+
+func TestPartsInFlightBoundedByConcurrency(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(12*MinimumChunkSize))
+
+	client := newFakeS3()
+	client.partDelay = 20 * time.Millisecond
+	u := newTestUploader(client)
+	u.Concurrency = 3
+
+	if _, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if n := client.maxInFlight.Load(); n > int64(u.Concurrency) {
+		t.Errorf("%d parts were in flight at once, want at most %d", n, u.Concurrency)
+	} else if n < 2 {
+		t.Errorf("at most %d part was in flight at once, so parts weren't uploaded in parallel", n)
+	}
+}
+
+func TestCheckPartSizes(t *testing.T) {
+	parts := make([]types.CompletedPart, 3)
+	for i := range parts {
+		parts[i] = types.CompletedPart{PartNumber: aws.Int32(int32(i + 1))}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sizes   map[int32]int64
+		badPart string
+	}{
+		{"every part at the minimum", map[int32]int64{1: MinimumChunkSize, 2: MinimumChunkSize, 3: MinimumChunkSize}, ""},
+		{"small final part", map[int32]int64{1: MinimumChunkSize, 2: MinimumChunkSize, 3: 1}, ""},
+		{"unknown sizes", map[int32]int64{3: 1}, ""},
+		{"undersized first part", map[int32]int64{1: MinimumChunkSize - 1, 2: MinimumChunkSize, 3: 1}, "part 1 "},
+		{"undersized middle part", map[int32]int64{1: MinimumChunkSize, 2: 100, 3: MinimumChunkSize}, "part 2 "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkPartSizes(parts, tc.sizes)
+
+			if tc.badPart == "" && err != nil {
+				t.Errorf("got error %v, want none", err)
+			} else if tc.badPart != "" && (err == nil || !strings.Contains(err.Error(), tc.badPart)) {
+				t.Errorf("got error %v, want one naming %q", err, tc.badPart)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package stitch
+
+import (
+	"context"
+	"sync"
+)
+
+// PauseGate holds part workers back while paused without aborting the
+// upload, so it can wait out a lost connection. Parts already being sent
+// carry on, but a failed part waits for the gate before retrying rather than
+// using up its retries. The zero value is running.
+type PauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+// Pause stops workers from starting new parts, reporting whether the gate
+// was running
+func (g *PauseGate) Pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		return false
+	}
+
+	g.paused = true
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// Resume lets waiting workers carry on, reporting whether the gate was paused
+func (g *PauseGate) Resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		return false
+	}
+
+	g.paused = false
+	close(g.resumed)
+	return true
+}
+
+func (g *PauseGate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paused
+}
+
+// wait blocks while the gate is paused, returning false if ctx ends first. A
+// nil gate never pauses.
+func (g *PauseGate) wait(ctx context.Context) bool {
+	if g == nil {
+		return ctx.Err() == nil
+	}
+
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+
+	if !paused {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,45 @@
+package stitch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ErrPreconditionFailed is wrapped when S3 rejects the upload because of
+// IfMatch or IfNoneMatch, meaning the object changed or was created by
+// someone else in the meantime.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+func validatePreconditions(cfg UploadConfiguration) error {
+	if cfg.IfMatch != "" && cfg.IfNoneMatch != "" {
+		return errors.New("if-match and if-none-match can't be used together")
+	}
+
+	// S3 only supports the wildcard, which means the object must not exist
+	if cfg.IfNoneMatch != "" && cfg.IfNoneMatch != "*" {
+		return fmt.Errorf("if-none-match must be *, got %q", cfg.IfNoneMatch)
+	}
+
+	return nil
+}
+
+// preconditionError wraps err with ErrPreconditionFailed when S3 responded
+// with 412 Precondition Failed, and returns it unchanged otherwise
+func preconditionError(cfg UploadConfiguration, err error) error {
+	var apiErr smithy.APIError
+	var responseErr *smithyhttp.ResponseError
+	if !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed") &&
+		!(errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusPreconditionFailed) {
+		return err
+	}
+
+	if cfg.IfNoneMatch != "" {
+		return fmt.Errorf("%w: s3://%s/%s already exists: %v", ErrPreconditionFailed, cfg.Bucket, cfg.Key, err)
+	}
+
+	return fmt.Errorf("%w: s3://%s/%s no longer has ETag %s: %v", ErrPreconditionFailed, cfg.Bucket, cfg.Key, cfg.IfMatch, err)
+}
@@ -0,0 +1,93 @@
+package stitch
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progress redraws a progress bar and calls the progress callback as parts
+// complete
+type progress struct {
+	mu sync.Mutex
+
+	out io.Writer
+	fn  func(partNum int32, bytesThisPart int, totalUploaded int64)
+
+	// total is -1 when the size of the source isn't known
+	total    int64
+	uploaded int64
+	session  int64
+	start    time.Time
+}
+
+func newProgress(out io.Writer, fn func(int32, int, int64), total int64, alreadyUploaded int64) *progress {
+	return &progress{
+		out:      out,
+		fn:       fn,
+		total:    total,
+		uploaded: alreadyUploaded,
+		start:    time.Now(),
+	}
+}
+
+func (p *progress) partUploaded(partNum int32, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.uploaded += int64(n)
+	p.session += int64(n)
+
+	if p.fn != nil {
+		p.fn(partNum, n, p.uploaded)
+	}
+
+	if p.out != nil {
+		p.render()
+	}
+}
+
+// finish moves the cursor past the progress bar so later output starts on a
+// fresh line
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.out != nil && p.session > 0 {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *progress) render() {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.session) / elapsed
+	}
+
+	// Without a known total there is nothing to measure a bar or ETA against
+	if p.total < 0 {
+		fmt.Fprintf(p.out, "\r%10.1f MB uploaded  %7.2f MB/s", float64(p.uploaded)/(1024*1024), rate/(1024*1024))
+		return
+	}
+
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(p.uploaded) / float64(p.total)
+	}
+
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	eta := "--"
+	if rate > 0 {
+		remaining := time.Duration(float64(p.total-p.uploaded)/rate) * time.Second
+		eta = remaining.Round(time.Second).String()
+	}
+
+	fmt.Fprintf(p.out, "\r[%s] %5.1f%%  %7.2f MB/s  ETA %-10s", bar, fraction*100, rate/(1024*1024), eta)
+}
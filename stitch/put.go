@@ -0,0 +1,169 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type putObjectAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+func optionalContentMD5(cfg UploadConfiguration, data []byte) *string {
+	if !cfg.ContentMD5 {
+		return nil
+	}
+
+	return aws.String(contentMD5(data))
+}
+
+// putObject uploads a source that is empty, too small for a multipart upload,
+// or below the multipart threshold with a single PutObject, applying the same
+// object settings as Upload. The request takes a slot from budget like a part
+// would.
+func (u *Uploader) putObject(ctx context.Context, cfg UploadConfiguration, src *source, budget partBudget) (*UploadResult, error) {
+	client, ok := u.Client.(putObjectAPI)
+
+	if !ok {
+		return nil, errors.New("cannot upload small file: client does not implement PutObject")
+	}
+
+	if cfg.SkipExisting {
+		exists, err := u.existingObject(ctx, cfg, src)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			u.logger().Info("Skipped, object is already present", "bucket", cfg.Bucket, "key", cfg.Key)
+			return &UploadResult{Skipped: true}, nil
+		}
+	}
+
+	contentType, err := resolveContentType(cfg, src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(src.r)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file at byte offset %d: %v", len(data), err)
+	}
+
+	if !budget.acquire(ctx) {
+		return nil, ctx.Err()
+	}
+	defer budget.release()
+
+	input := &s3.PutObjectInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+		ContentLength:       aws.Int64(int64(len(data))),
+		ChecksumAlgorithm:   cfg.ChecksumAlgorithm,
+		ContentMD5:          optionalContentMD5(cfg, data),
+		StorageClass:        cfg.StorageClass,
+		ACL:                 cfg.ACL,
+		ContentType:         &contentType,
+		Metadata:            cfg.Metadata,
+		Tagging:             encodeTags(cfg.Tags),
+		IfMatch:             optionalString(cfg.IfMatch),
+		IfNoneMatch:         optionalString(cfg.IfNoneMatch),
+
+		CacheControl:       optionalString(cfg.CacheControl),
+		ContentDisposition: optionalString(cfg.ContentDisposition),
+		ContentEncoding:    optionalString(cfg.ContentEncoding),
+		Expires:            optionalTime(cfg.Expires),
+
+		ServerSideEncryption:    cfg.ServerSideEncryption,
+		SSEKMSKeyId:             optionalString(cfg.SSEKMSKeyId),
+		SSEKMSEncryptionContext: encodeEncryptionContext(cfg.SSEKMSEncryptionContext),
+
+		ObjectLockMode:            cfg.ObjectLockMode,
+		ObjectLockRetainUntilDate: optionalTime(cfg.ObjectLockRetainUntil),
+		ObjectLockLegalHoldStatus: cfg.ObjectLockLegalHold,
+	}
+
+	putResp, err := u.sendPutObject(ctx, client, input, data)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to put object: %w", preconditionError(cfg, err))
+	}
+
+	// The whole object counts as a single part
+	if u.ProgressFunc != nil {
+		u.ProgressFunc(1, len(data), int64(len(data)))
+	}
+
+	checksum := sha256.Sum256(data)
+
+	result := &UploadResult{
+		ETag:       aws.ToString(putResp.ETag),
+		TotalBytes: int64(len(data)),
+		PartCount:  1,
+		SHA256:     hex.EncodeToString(checksum[:]),
+
+		ChunkSize:     int64(len(data)),
+		FinalPartSize: int64(len(data)),
+	}
+
+	if cfg.Verify {
+		if err := u.verifyObject(ctx, cfg, result); err != nil {
+			return result, err
+		}
+
+		if err := u.verifyChecksum(ctx, cfg, result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// sendPutObject sends the object, retrying transient failures like a part,
+// since a file below the multipart threshold would otherwise have none of
+// the retries it gets as a multipart upload
+func (u *Uploader) sendPutObject(ctx context.Context, client putObjectAPI, input *s3.PutObjectInput, data []byte) (*s3.PutObjectOutput, error) {
+	refreshed := false
+
+	for attempt := 0; ; attempt++ {
+		input.Body = bytes.NewReader(data)
+
+		reqCtx, cancel := u.requestContext(ctx)
+		putResp, err := client.PutObject(reqCtx, input)
+		cancel()
+
+		if err == nil {
+			return putResp, nil
+		}
+
+		if !refreshed && u.refreshExpired(ctx, err) {
+			refreshed = true
+			attempt--
+			continue
+		}
+
+		if attempt >= u.MaxRetries || ctx.Err() != nil || !(isRetryable(err) || timedOut(ctx, err)) {
+			return nil, err
+		}
+
+		delay := backoff(u.RetryBaseDelay, attempt)
+		u.logger().Warn("Retrying object", "key", aws.ToString(input.Key), "delay", delay, "attempt", attempt+1, "maxRetries", u.MaxRetries, "error", err)
+
+		if !u.sleep(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestEmptyFileIsPutWithoutMultipart(t *testing.T) {
+	path := writeTestFile(t, "empty.bin", nil)
+
+	client := newFakeS3()
+	u := newTestUploader(client)
+
+	result, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if calls := client.recorded(); !slices.Equal(calls, []string{"PutObject"}) {
+		t.Errorf("sent %v, want a single PutObject", calls)
+	}
+
+	if object, ok := client.object("key"); !ok || len(object) != 0 {
+		t.Errorf("got object of %d bytes, want an empty object", len(object))
+	}
+
+	if result.TotalBytes != 0 {
+		t.Errorf("result counts %d bytes, want 0", result.TotalBytes)
+	}
+
+	if etag, err := u.ObjectETag(UploadConfiguration{FilePath: path, ChunkSize: MinimumChunkSize}); err != nil || etag != strings.Trim(result.ETag, `"`) {
+		t.Errorf("computed ETag %s (%v), want %s", etag, err, result.ETag)
+	}
+}
+
+func TestMultipartThreshold(t *testing.T) {
+	const threshold = 8 * 1024 * 1024
+
+	for _, tc := range []struct {
+		name      string
+		size      int
+		threshold int64
+		maxMemory int64
+		put       bool
+	}{
+		{"below the threshold", threshold - 1, threshold, 0, true},
+		{"at the threshold", threshold, threshold, 0, false},
+		{"above the threshold", threshold + 1, threshold, 0, false},
+		{"small file without a threshold", 10, 0, 0, false},
+		{"below a threshold capped by memory", threshold - 1, threshold, MinimumChunkSize, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := testData(tc.size)
+			path := writeTestFile(t, "data.bin", data)
+
+			client := newFakeS3()
+			u := newTestUploader(client)
+			u.MaxMemory = tc.maxMemory
+
+			cfg := UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize, MultipartThreshold: tc.threshold}
+
+			result, err := u.Upload(context.Background(), cfg)
+
+			if err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			calls := client.recorded()
+
+			if put := slices.Equal(calls, []string{"PutObject"}); put != tc.put {
+				t.Errorf("sent %v, want sent with a single PutObject %t", calls, tc.put)
+			}
+
+			if !tc.put && client.count("CompleteMultipartUpload") != 1 {
+				t.Errorf("sent %v, want a completed multipart upload", calls)
+			}
+
+			if object, _ := client.object("key"); !bytes.Equal(object, data) {
+				t.Error("object doesn't match the file")
+			}
+
+			etag, err := u.ObjectETag(cfg)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The fake's multipart ETags aren't derived from the parts, so
+			// only a put one can be compared with what was stored
+			want := strings.Trim(result.ETag, `"`)
+			if !tc.put {
+				want, _ = MultipartETag(path, cfg.ChunkSize)
+			}
+
+			if etag != want {
+				t.Errorf("computed ETag %s, want %s", etag, want)
+			}
+		})
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		noComplete bool
+		given      bool
+		put        bool
+	}{
+		{"new upload", false, false, true},
+		{"left for completion", true, false, false},
+		{"given upload", false, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeS3()
+			u := newTestUploader(client)
+
+			cfg := UploadConfiguration{Bucket: "bucket", Key: "key", ChunkSize: MinimumChunkSize, NoComplete: tc.noComplete}
+
+			if tc.given {
+				created, err := client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cfg.UploadId = aws.ToString(created.UploadId)
+			}
+
+			_, err := u.UploadReader(context.Background(), cfg, bytes.NewReader(nil), -1)
+
+			if tc.put {
+				if err != nil {
+					t.Fatalf("upload failed: %v", err)
+				}
+
+				if _, ok := client.object("key"); !ok || client.openUploads() != 0 {
+					t.Errorf("sent %v, want the upload replaced with a PutObject", client.recorded())
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidConfiguration) {
+				t.Fatalf("got error %v, want %v", err, ErrInvalidConfiguration)
+			}
+
+			if client.count("AbortMultipartUpload") != 0 || client.openUploads() != 1 {
+				t.Errorf("sent %v, want the upload kept", client.recorded())
+			}
+		})
+	}
+}
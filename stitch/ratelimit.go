@@ -0,0 +1,53 @@
+package stitch
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBurst caps how much a single Read may take from the limiter, so a
+// large read can't drain the shared budget in one go
+const rateLimitBurst = 64 * 1024
+
+// rateLimiter returns the limiter shared by every part of every upload this
+// Uploader runs, so MaxRate bounds the combined throughput even when several
+// files upload at once. It is nil when MaxRate is unset.
+func (u *Uploader) rateLimiter() *rate.Limiter {
+	u.limiterOnce.Do(func() {
+		if u.MaxRate > 0 {
+			u.limiter = rate.NewLimiter(rate.Limit(u.MaxRate), rateLimitBurst)
+		}
+	})
+
+	return u.limiter
+}
+
+// rateLimitedReader throttles a part body against a limiter shared by every
+// worker. It is still seekable so the SDK can size and rewind the body.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.ReadSeeker
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitBurst {
+		p = p[:rateLimitBurst]
+	}
+
+	n, err := r.r.Read(p)
+
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+func (r *rateLimitedReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
@@ -0,0 +1,142 @@
+package stitch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrUploadNotFound is wrapped when S3 no longer has the multipart upload
+// being resumed, because it was completed, aborted, or removed by a lifecycle
+// rule.
+var ErrUploadNotFound = errors.New("upload id no longer exists")
+
+// uploadNotFoundError wraps err with ErrUploadNotFound when S3 responded with
+// NoSuchUpload, and returns it unchanged otherwise
+func uploadNotFoundError(uploadId string, err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "NoSuchUpload" {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s, start a fresh upload: %v", ErrUploadNotFound, uploadId, err)
+}
+
+func (u *Uploader) listUploadedParts(ctx context.Context, cfg UploadConfiguration, uploadId string) ([]types.Part, error) {
+	client, ok := u.Client.(s3.ListPartsAPIClient)
+
+	if !ok {
+		return nil, errors.New("cannot resume upload: client does not implement ListParts")
+	}
+
+	paginator := s3.NewListPartsPaginator(client, &s3.ListPartsInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+		UploadId:            &uploadId,
+	})
+
+	var parts []types.Part
+
+	for paginator.HasMorePages() {
+		reqCtx, cancel := u.requestContext(ctx)
+		page, err := paginator.NextPage(reqCtx)
+		cancel()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", uploadNotFoundError(uploadId, err))
+		}
+
+		parts = append(parts, page.Parts...)
+	}
+
+	return parts, nil
+}
+
+// reusableParts returns the already uploaded parts that match the local file
+// and can be skipped. Every part but the last must be exactly chunkSize, so
+// any other size means the upload was started with a different chunk size.
+// A last part with the wrong size was interrupted and is uploaded again.
+//
+// The file's parts are numbered from firstPart. Parts outside that range are
+// returned as others, belonging to other writers of the upload, except that a
+// part past the end of a file starting at part 1 means the file has shrunk.
+//
+// With requireAligned a mismatched last part fails the resume rather than
+// being uploaded again, as do other writers' parts before the file's that
+// aren't a full chunk.
+func reusableParts(parts []types.Part, chunkSize int64, fileSize int64, firstPart int32, requireAligned bool) (reusable map[int32]types.Part, others []types.Part, err error) {
+	totalParts := int32((fileSize + chunkSize - 1) / chunkSize)
+	lastPart := firstPart + totalParts - 1
+
+	reusable = make(map[int32]types.Part, len(parts))
+
+	for _, part := range parts {
+		partNum := aws.ToInt32(part.PartNumber)
+		size := aws.ToInt64(part.Size)
+
+		if partNum < firstPart && requireAligned && size != chunkSize {
+			return nil, nil, fmt.Errorf("part %d is %d bytes, not aligned to the chunk size of %d", partNum, size, chunkSize)
+		}
+
+		if partNum < firstPart || (partNum > lastPart && firstPart > 1) {
+			others = append(others, part)
+			continue
+		}
+
+		if partNum > lastPart {
+			return nil, nil, fmt.Errorf("part %d exists but the file only has %d parts at a chunk size of %d", partNum, totalParts, chunkSize)
+		}
+
+		if partNum < lastPart {
+			if size != chunkSize {
+				return nil, nil, fmt.Errorf("part %d is %d bytes but the chunk size is %d, resume with the original chunk size", partNum, size, chunkSize)
+			}
+
+			reusable[partNum] = part
+			continue
+		}
+
+		if finalSize := fileSize - int64(totalParts-1)*chunkSize; size == finalSize {
+			reusable[partNum] = part
+		} else if requireAligned {
+			return nil, nil, fmt.Errorf("last part %d is %d bytes but the file ends with %d at a chunk size of %d, not aligned to the upload being resumed",
+				partNum, size, finalSize, chunkSize)
+		}
+	}
+
+	return reusable, others, nil
+}
+
+// withOtherParts adds the parts of other writers to the file's completed
+// parts, keeping them ordered by part number as completion requires
+func withOtherParts(completed []types.CompletedPart, others []types.Part, algorithm types.ChecksumAlgorithm) []types.CompletedPart {
+	for _, part := range others {
+		other := types.CompletedPart{
+			ETag:       part.ETag,
+			PartNumber: part.PartNumber,
+		}
+		setCompletedChecksum(&other, algorithm, existingChecksum(part, algorithm))
+
+		completed = append(completed, other)
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	return completed
+}
+
+// ListParts lists the parts stored so far for a multipart upload, following
+// every page of results, for example to see whether it can be resumed.
+func (u *Uploader) ListParts(ctx context.Context, bucket string, key string, uploadId string) ([]types.Part, error) {
+	return u.listUploadedParts(ctx, UploadConfiguration{Bucket: bucket, Key: key}, uploadId)
+}
@@ -0,0 +1,97 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestResumeMissingUpload(t *testing.T) {
+	data := testData(2*MinimumChunkSize + 10)
+	path := writeTestFile(t, "data.bin", data)
+
+	cfg := UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize, UploadId: "gone"}
+
+	t.Run("fails", func(t *testing.T) {
+		client := newFakeS3()
+		u := newTestUploader(client)
+
+		_, err := u.Upload(context.Background(), cfg)
+
+		if !errors.Is(err, ErrUploadNotFound) {
+			t.Fatalf("got error %v, want %v", err, ErrUploadNotFound)
+		}
+
+		if n := client.count("CreateMultipartUpload") + client.count("UploadPart"); n > 0 {
+			t.Errorf("sent %v after the upload was found missing", client.recorded())
+		}
+	})
+
+	t.Run("restarts", func(t *testing.T) {
+		client := newFakeS3()
+		u := newTestUploader(client)
+
+		restartCfg := cfg
+		restartCfg.RestartMissingUpload = true
+
+		result, err := u.Upload(context.Background(), restartCfg)
+
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+
+		if result.UploadId == cfg.UploadId || client.count("CreateMultipartUpload") != 1 {
+			t.Errorf("upload %s wasn't started afresh, calls %v", result.UploadId, client.recorded())
+		}
+
+		if object, _ := client.object("key"); !bytes.Equal(object, data) {
+			t.Error("object doesn't match the file")
+		}
+	})
+}
+
+func TestUploadRemovedWhileSendingParts(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(2*MinimumChunkSize))
+
+	client := newFakeS3()
+	client.failPart(1, -1, apiError("NoSuchUpload"))
+	u := newTestUploader(client)
+
+	_, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("got error %v, want %v", err, ErrUploadNotFound)
+	}
+
+	if n := client.count("UploadPart"); n > 2 {
+		t.Errorf("made %d UploadPart calls for 2 parts, want no retries of a missing upload", n)
+	}
+}
+
+func TestSharedUploadKeptWhenCompletionIsRejected(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(MinimumChunkSize))
+
+	client := newFakeS3()
+	client.completeErr = apiError("InvalidPart")
+	u := newTestUploader(client)
+
+	created, err := client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize, UploadId: aws.ToString(created.UploadId), StartPart: 2}
+
+	if _, err := u.Upload(context.Background(), cfg); err == nil {
+		t.Fatal("upload succeeded despite a rejected completion")
+	}
+
+	if client.count("AbortMultipartUpload") != 0 || client.openUploads() != 1 {
+		t.Errorf("sent %v, want the upload shared with other writers kept", client.recorded())
+	}
+}
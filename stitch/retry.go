@@ -0,0 +1,245 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+const DefaultMaxRetries = 3
+const DefaultRetryBaseDelay = 500 * time.Millisecond
+
+// Error codes that will never succeed on a retry, so the upload fails fast
+var nonRetryableCodes = map[string]bool{
+	"AccessDenied":          true,
+	"NoSuchUpload":          true,
+	"NoSuchBucket":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+}
+
+// Error codes worth retrying that the SDK's checks miss, because S3 can send
+// them in the body of a 200 response to CompleteMultipartUpload
+var retryableCodes = map[string]bool{
+	"InternalError": true,
+}
+
+// Error codes for credentials that expired, which RefreshCredentials can fix
+var expiredCredentialCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"TokenRefreshRequired":  true,
+}
+
+func (u *Uploader) uploadSinglePart(ctx context.Context, cfg UploadConfiguration, limiter *rate.Limiter, uploadId string, partNum int32, data []byte) (types.CompletedPart, error) {
+	input := &s3.UploadPartInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+		PartNumber:          aws.Int32(partNum),
+		UploadId:            &uploadId,
+
+		// The rate limited body hides its length from the SDK
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+
+	// A trailing checksum is left for the SDK to compute as the part is sent
+	var checksum *string
+	if cfg.ChecksumAlgorithm != "" && cfg.ChecksumMode == ChecksumModeTrailer {
+		input.ChecksumAlgorithm = cfg.ChecksumAlgorithm
+	} else if cfg.ChecksumAlgorithm != "" {
+		checksum = aws.String(partChecksum(cfg.ChecksumAlgorithm, data))
+		setPartChecksum(input, cfg.ChecksumAlgorithm, checksum)
+	}
+
+	// Computed over the exact bytes sent, which every retry resends unchanged
+	if cfg.ContentMD5 {
+		input.ContentMD5 = aws.String(contentMD5(data))
+	}
+
+	start := u.clock().Now()
+	refreshed := false
+
+	for attempt := 0; ; attempt++ {
+		input.Body = bytes.NewReader(data)
+
+		if limiter != nil {
+			input.Body = &rateLimitedReader{ctx: ctx, r: bytes.NewReader(data), limiter: limiter}
+		}
+
+		reqCtx, cancel := u.requestContext(ctx)
+		partResp, err := u.Client.UploadPart(reqCtx, input)
+		cancel()
+
+		if err == nil {
+			part := types.CompletedPart{
+				ETag:       partResp.ETag,
+				PartNumber: aws.Int32(partNum),
+			}
+
+			// Completion needs every part's checksum, so one the endpoint
+			// didn't echo back is computed here after all
+			partSum := checksum
+			if partSum == nil && cfg.ChecksumAlgorithm != "" {
+				if partSum = uploadedChecksum(partResp, cfg.ChecksumAlgorithm); partSum == nil {
+					partSum = aws.String(partChecksum(cfg.ChecksumAlgorithm, data))
+				}
+			}
+			setCompletedChecksum(&part, cfg.ChecksumAlgorithm, partSum)
+
+			u.metrics().PartUploaded(len(data), u.clock().Now().Sub(start))
+			return part, nil
+		}
+
+		// Fresh credentials are tried once without using up a retry
+		if !refreshed && u.refreshExpired(ctx, err) {
+			refreshed = true
+			attempt--
+			continue
+		}
+
+		// A part that failed while paused, likely for the lost connection the
+		// pause is waiting out, is retried once resumed without using a retry
+		if u.Pause != nil && u.Pause.Paused() && ctx.Err() == nil {
+			if !u.Pause.wait(ctx) {
+				return types.CompletedPart{}, ctx.Err()
+			}
+
+			attempt--
+			continue
+		}
+
+		if attempt >= u.MaxRetries || ctx.Err() != nil || !(isRetryable(err) || timedOut(ctx, err)) {
+			// Parts cancelled because of another failure aren't failures themselves
+			if ctx.Err() == nil {
+				u.metrics().PartFailed()
+				u.logger().Debug("Not retrying part", "part", partNum, "attempt", attempt+1, "maxRetries", u.MaxRetries,
+					"retryable", isRetryable(err) || timedOut(ctx, err), "error", err)
+			}
+
+			return types.CompletedPart{}, err
+		}
+
+		u.metrics().PartRetried()
+		partRetried(ctx, attempt, err)
+		delay := backoff(u.RetryBaseDelay, attempt)
+		u.logger().Warn("Retrying part", "part", partNum, "delay", delay, "attempt", attempt+1, "maxRetries", u.MaxRetries, "error", err)
+
+		if !u.sleep(ctx, delay) {
+			return types.CompletedPart{}, ctx.Err()
+		}
+	}
+}
+
+// completeUpload completes the upload, retrying transient failures like a
+// part. S3 occasionally fails a completion with a 500 even though every part
+// is stored, and the same completion succeeds when sent again.
+func (u *Uploader) completeUpload(ctx context.Context, cfg UploadConfiguration, uploadId string, parts []types.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+		UploadId:            &uploadId,
+		IfMatch:             optionalString(cfg.IfMatch),
+		IfNoneMatch:         optionalString(cfg.IfNoneMatch),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: parts,
+		},
+	}
+
+	refreshed := false
+
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := u.requestContext(ctx)
+		completeResp, err := u.Client.CompleteMultipartUpload(reqCtx, input)
+		cancel()
+
+		if err == nil {
+			return completeResp, nil
+		}
+
+		if !refreshed && u.refreshExpired(ctx, err) {
+			refreshed = true
+			attempt--
+			continue
+		}
+
+		if attempt >= u.MaxRetries || ctx.Err() != nil || !(isRetryable(err) || timedOut(ctx, err)) {
+			return nil, err
+		}
+
+		delay := backoff(u.RetryBaseDelay, attempt)
+		u.logger().Warn("Retrying completion", "uploadId", uploadId, "delay", delay, "attempt", attempt+1, "maxRetries", u.MaxRetries, "error", err)
+
+		if !u.sleep(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// refreshExpired refreshes the credentials when err says they expired,
+// reporting whether the request should be sent again
+func (u *Uploader) refreshExpired(ctx context.Context, err error) bool {
+	var apiErr smithy.APIError
+	if u.RefreshCredentials == nil || ctx.Err() != nil || !errors.As(err, &apiErr) || !expiredCredentialCodes[apiErr.ErrorCode()] {
+		return false
+	}
+
+	u.logger().Warn("Credentials expired, refreshing", "error", err)
+
+	if err := u.RefreshCredentials(ctx); err != nil {
+		u.logger().Error("Failed to refresh credentials", "error", err)
+		return false
+	}
+
+	return true
+}
+
+func isRetryable(err error) bool {
+	var apiErr smithy.APIError
+
+	if errors.As(err, &apiErr) && nonRetryableCodes[apiErr.ErrorCode()] {
+		return false
+	}
+
+	if errors.As(err, &apiErr) && retryableCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// maxBackoff caps the window backoff doubles, which would otherwise grow past
+// any useful wait and overflow with a large -maxRetries. A base delay longer
+// than it is kept as given.
+const maxBackoff = 20 * time.Second
+
+// backoff doubles the base delay for every attempt, up to maxBackoff, and picks
+// a random point in the upper half of that window so parallel workers don't
+// retry in lockstep
+func backoff(base time.Duration, attempt int) time.Duration {
+	// Checked before shifting, as the shift itself is what overflows
+	delay := max(base, maxBackoff)
+	if base <= maxBackoff>>attempt {
+		delay = base << attempt
+	}
+
+	half := delay / 2
+
+	if half <= 0 {
+		return delay
+	}
+
+	return half + rand.N(half)
+}
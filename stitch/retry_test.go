@@ -0,0 +1,131 @@
+package stitch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestBackoffStaysInUpperHalfOfWindow(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	for attempt := range 5 {
+		window := base << attempt
+
+		for range 100 {
+			if delay := backoff(base, attempt); delay < window/2 || delay >= window {
+				t.Fatalf("attempt %d waited %v, want within [%v, %v)", attempt, delay, window/2, window)
+			}
+		}
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	for _, attempt := range []int{10, 62, 63, 64, 1000} {
+		if delay := backoff(DefaultRetryBaseDelay, attempt); delay < maxBackoff/2 || delay >= maxBackoff {
+			t.Errorf("attempt %d waited %v, want within [%v, %v)", attempt, delay, maxBackoff/2, maxBackoff)
+		}
+	}
+
+	if delay := backoff(time.Minute, 3); delay < 30*time.Second || delay >= time.Minute {
+		t.Errorf("waited %v with a base delay of a minute, want the base delay kept", delay)
+	}
+}
+
+func TestPartRetriesWithBackoff(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(2*MinimumChunkSize))
+
+	client := newFakeS3()
+	client.failPart(2, 2, apiError("InternalError"))
+
+	clock := newFakeClock()
+	u := NewUploader(client)
+	u.Clock = clock
+	u.RetryBaseDelay = 100 * time.Millisecond
+
+	start := clock.Now()
+	_, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	waits := clock.waited()
+
+	if len(waits) != 2 {
+		t.Fatalf("waited %d times, want 2 for the 2 retries", len(waits))
+	}
+
+	for attempt, wait := range waits {
+		window := u.RetryBaseDelay << attempt
+
+		if wait < window/2 || wait >= window {
+			t.Errorf("retry %d waited %v, want within [%v, %v)", attempt+1, wait, window/2, window)
+		}
+	}
+
+	if elapsed := clock.Now().Sub(start); elapsed != waits[0]+waits[1] {
+		t.Errorf("clock moved %v, want the %v waited", elapsed, waits[0]+waits[1])
+	}
+
+	if n := client.count("UploadPart"); n != 4 {
+		t.Errorf("sent %d part requests, want 2 parts and 2 retries", n)
+	}
+}
+
+func TestPartGivesUpAfterLastRetry(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(MinimumChunkSize))
+
+	client := newFakeS3()
+	client.failPart(1, -1, apiError("InternalError"))
+
+	clock := newFakeClock()
+	u := NewUploader(client)
+	u.Clock = clock
+	u.MaxRetries = 3
+
+	_, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "InternalError" {
+		t.Fatalf("got error %v, want the part's last InternalError", err)
+	}
+
+	if n := client.count("UploadPart"); n != u.MaxRetries+1 {
+		t.Errorf("sent the part %d times, want the first attempt and %d retries", n, u.MaxRetries)
+	}
+
+	if n := len(clock.waited()); n != u.MaxRetries {
+		t.Errorf("waited %d times, want one before each of %d retries", n, u.MaxRetries)
+	}
+
+	if client.count("AbortMultipartUpload") != 1 {
+		t.Errorf("upload wasn't aborted after giving up, calls %v", client.recorded())
+	}
+}
+
+func TestNonRetryablePartFailsWithoutWaiting(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(MinimumChunkSize))
+
+	client := newFakeS3()
+	client.failPart(1, -1, apiError("AccessDenied"))
+
+	clock := newFakeClock()
+	u := NewUploader(client)
+	u.Clock = clock
+
+	if _, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize}); err == nil {
+		t.Fatal("upload succeeded despite access being denied")
+	}
+
+	if n := client.count("UploadPart"); n != 1 {
+		t.Errorf("sent the part %d times, want no retries", n)
+	}
+
+	if waits := clock.waited(); len(waits) != 0 {
+		t.Errorf("waited %v before failing", waits)
+	}
+}
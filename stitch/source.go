@@ -0,0 +1,158 @@
+package stitch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// StdinPath as the FilePath reads the upload from standard input.
+const StdinPath = "-"
+
+// sniffLen is how much of the content http.DetectContentType looks at
+const sniffLen = 512
+
+// source is the data being uploaded. Size is -1 when the length isn't known
+// up front, as with a pipe.
+type source struct {
+	r    io.Reader
+	size int64
+
+	// stream sources can't be reopened or read at an offset
+	stream bool
+
+	close func() error
+}
+
+func openSource(filePath string) (*source, error) {
+	if filePath == StdinPath {
+		return readerSource(os.Stdin, -1), nil
+	}
+
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	// The size is fixed here so a file that is still being written uploads
+	// deterministically, as whatever it held when it was opened
+	return &source{r: &snapshotReader{f: f, size: info.Size(), remaining: info.Size()}, size: info.Size(), close: f.Close}, nil
+}
+
+// readerSource streams r, checking it produces exactly size bytes when size
+// isn't -1. Closing r is left to its owner.
+func readerSource(r io.Reader, size int64) *source {
+	if size >= 0 {
+		r = &sizedReader{r: r, size: size, remaining: size}
+	}
+
+	return &source{
+		r:      bufio.NewReaderSize(r, sniffLen),
+		size:   size,
+		stream: true,
+		close:  func() error { return nil },
+	}
+}
+
+// sizedReader fails once r turns out longer or shorter than the size it was
+// given for, since the upload was planned around that size
+type sizedReader struct {
+	r         io.Reader
+	size      int64
+	remaining int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+
+	if r.remaining < 0 {
+		return n, fmt.Errorf("input is longer than its size of %d bytes", r.size)
+	}
+
+	if err == io.EOF && r.remaining > 0 {
+		return n, fmt.Errorf("input ended after %d bytes, expected %d", r.size-r.remaining, r.size)
+	}
+
+	return n, err
+}
+
+// snapshotReader reads a file only up to the size it had when opened, leaving
+// out anything appended later, and fails if the file shrinks below that
+type snapshotReader struct {
+	f         *os.File
+	size      int64
+	remaining int64
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.f.Read(p)
+	r.remaining -= int64(n)
+
+	if err == io.EOF && r.remaining > 0 {
+		return n, fmt.Errorf("file shrank while uploading, expected %d bytes but it ended after %d", r.size, r.size-r.remaining)
+	}
+
+	return n, err
+}
+
+// ReadAt lets the content type be sniffed without moving the read offset
+func (r *snapshotReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off)
+}
+
+// Transient read errors are retried this many times, this far apart, before
+// the upload fails
+const maxReadRetries = 3
+const readRetryDelay = 100 * time.Millisecond
+
+// readChunk fills buffer from the source, returning 0 at the end of the data.
+// Any reader, files included, may return fewer bytes than asked for without
+// being at the end, so the buffer is filled with io.ReadFull to keep every
+// part but the last at the full chunk size and above the S3 minimum. On an
+// error n is how much of the buffer was filled before it. Retries wait on
+// clock.
+func (s *source) readChunk(buffer []byte, clock Clock) (int, error) {
+	var n int
+
+	for attempt := 0; ; attempt++ {
+		read, err := io.ReadFull(s.r, buffer[n:])
+		n += read
+
+		if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+
+		if !transientReadError(err) || attempt == maxReadRetries {
+			return n, err
+		}
+
+		<-clock.After(readRetryDelay)
+	}
+}
+
+// transientReadError reports whether a read may succeed if tried again, as
+// with a non-blocking descriptor that had no data ready
+func transientReadError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,152 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// recordPartSizes has u record the size of every part it sends, in part order
+func recordPartSizes(u *Uploader) func() []int {
+	var mu sync.Mutex
+	sizes := make(map[int32]int)
+
+	u.ProgressFunc = func(partNum int32, bytesThisPart int, totalUploaded int64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sizes[partNum] = bytesThisPart
+	}
+
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent := make([]int, len(sizes))
+		for partNum, size := range sizes {
+			sent[partNum-1] = size
+		}
+
+		return sent
+	}
+}
+
+func TestShortReadsFillEveryPart(t *testing.T) {
+	data := testData(2*MinimumChunkSize + 300)
+	want := []int{MinimumChunkSize, MinimumChunkSize, 300}
+
+	for _, tc := range []struct {
+		name string
+		r    func(io.Reader) io.Reader
+		size int64
+	}{
+		{"one byte reads", iotest.OneByteReader, int64(len(data))},
+		{"half reads", iotest.HalfReader, int64(len(data))},
+		{"one byte reads of unknown size", iotest.OneByteReader, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeS3()
+			u := newTestUploader(client)
+			sent := recordPartSizes(u)
+
+			cfg := UploadConfiguration{Bucket: "bucket", Key: "key", ChunkSize: MinimumChunkSize}
+
+			if _, err := u.UploadReader(context.Background(), cfg, tc.r(bytes.NewReader(data)), tc.size); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			if got := sent(); !slices.Equal(got, want) {
+				t.Errorf("sent parts of %v bytes, want %v", got, want)
+			}
+
+			if object, _ := client.object("key"); !bytes.Equal(object, data) {
+				t.Error("object doesn't match what was read")
+			}
+		})
+	}
+}
+
+// failingReader reads r until after bytes have been read, then fails with
+// err the next times reads before carrying on, or every read from then on
+// when times is negative
+type failingReader struct {
+	r     io.Reader
+	after int
+	err   error
+	times int
+
+	read int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.read >= f.after && f.times != 0 {
+		f.times--
+		return 0, f.err
+	}
+
+	if f.times != 0 {
+		p = p[:min(len(p), f.after-f.read)]
+	}
+
+	n, err := f.r.Read(p)
+	f.read += n
+
+	return n, err
+}
+
+func TestReadErrorAbortsUpload(t *testing.T) {
+	data := testData(3 * MinimumChunkSize)
+	readErr := errors.New("device unplugged")
+
+	client := newFakeS3()
+	u := newTestUploader(client)
+
+	r := &failingReader{r: bytes.NewReader(data), after: MinimumChunkSize + 1000, err: readErr, times: -1}
+	_, err := u.UploadReader(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", ChunkSize: MinimumChunkSize}, r, int64(len(data)))
+
+	if err == nil {
+		t.Fatal("upload succeeded despite the read error")
+	}
+
+	want := fmt.Sprintf("failed to read part 2 at byte offset %d: %v", MinimumChunkSize+1000, readErr)
+
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want one containing %q", err, want)
+	}
+
+	if client.count("AbortMultipartUpload") != 1 || client.openUploads() != 0 {
+		t.Errorf("upload wasn't aborted, calls %v", client.recorded())
+	}
+}
+
+func TestTransientReadErrorIsRetried(t *testing.T) {
+	data := testData(2*MinimumChunkSize + 10)
+
+	client := newFakeS3()
+	clock := newFakeClock()
+	u := newTestUploader(client)
+	u.Clock = clock
+
+	r := &failingReader{r: bytes.NewReader(data), after: MinimumChunkSize + 1000, err: syscall.EAGAIN, times: 2}
+
+	if _, err := u.UploadReader(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", ChunkSize: MinimumChunkSize}, r, int64(len(data))); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if waits := clock.waited(); !slices.Equal(waits, []time.Duration{readRetryDelay, readRetryDelay}) {
+		t.Errorf("waited %v between reads, want two waits of %v", waits, readRetryDelay)
+	}
+
+	if object, _ := client.object("key"); !bytes.Equal(object, data) {
+		t.Error("object doesn't match what was read")
+	}
+}
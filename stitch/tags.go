@@ -0,0 +1,69 @@
+package stitch
+
+import (
+	"fmt"
+	"net/url"
+	"unicode"
+	"unicode/utf8"
+)
+
+// S3 object tagging limits
+const maxTags = 10
+const maxTagKeyLength = 128
+const maxTagValueLength = 256
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags given but S3 allows at most %d", len(tags), maxTags)
+	}
+
+	for key, value := range tags {
+		if n := utf8.RuneCountInString(key); n == 0 || n > maxTagKeyLength {
+			return fmt.Errorf("tag key %q must be between 1 and %d characters", key, maxTagKeyLength)
+		}
+
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			return fmt.Errorf("tag value for %q must be at most %d characters", key, maxTagValueLength)
+		}
+
+		if !validTagText(key) || !validTagText(value) {
+			return fmt.Errorf("tag %s=%s may only contain letters, numbers, spaces, and + - = . _ : / @", key, value)
+		}
+	}
+
+	return nil
+}
+
+func validTagText(text string) bool {
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) {
+			continue
+		}
+
+		switch r {
+		case '+', '-', '=', '.', '_', ':', '/', '@':
+			continue
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// encodeTags formats tags as the URL query string S3 expects in the
+// x-amz-tagging header, or nil when there are none
+func encodeTags(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	values := url.Values{}
+
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+
+	encoded := values.Encode()
+	return &encoded
+}
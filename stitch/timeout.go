@@ -0,0 +1,25 @@
+package stitch
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const DefaultPartTimeout = 10 * time.Minute
+
+// requestContext bounds a single S3 request by PartTimeout so a hung
+// connection can't stall the upload forever
+func (u *Uploader) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.PartTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, u.PartTimeout)
+}
+
+// timedOut reports whether err came from the request's own deadline rather
+// than the caller's context, in which case the request is worth retrying
+func timedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
@@ -0,0 +1,32 @@
+package stitch
+
+import "time"
+
+// PartTiming is where the time went for one part when Uploader.Timing is set
+type PartTiming struct {
+	PartNumber int32
+	Size       int
+
+	// Read is how long the part took to read from the source, and Upload how
+	// long it took to store including any retries
+	Read   time.Duration
+	Upload time.Duration
+}
+
+// since returns the time elapsed from start, or zero when timing is off so
+// the clock isn't read for every part
+func (u *Uploader) since(start time.Time) time.Duration {
+	if !u.Timing {
+		return 0
+	}
+
+	return u.clock().Now().Sub(start)
+}
+
+func (u *Uploader) now() time.Time {
+	if !u.Timing {
+		return time.Time{}
+	}
+
+	return u.clock().Now()
+}
@@ -0,0 +1,63 @@
+package stitch
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func (u *Uploader) tracer() trace.Tracer {
+	if u.Tracer == nil {
+		return noop.Tracer{}
+	}
+
+	return u.Tracer
+}
+
+// startSpan starts a span for one step of the upload of cfg's object
+func (u *Uploader) startSpan(ctx context.Context, name string, cfg UploadConfiguration, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := u.tracer().Start(ctx, name)
+
+	// Attributes are only built for a span that is being recorded, keeping
+	// the no-op tracer free
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("aws.s3.bucket", cfg.Bucket), attribute.String("aws.s3.key", cfg.Key))
+		span.SetAttributes(attrs...)
+	}
+
+	return ctx, span
+}
+
+// endSpan marks the span failed when err is set, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// endPartSpan ends the span of a part upload that started at start
+func endPartSpan(span trace.Span, start time.Time, err error) {
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int64("stitch.part.duration_ms", time.Since(start).Milliseconds()))
+	}
+
+	endSpan(span, err)
+}
+
+// partRetried notes a retry on the part's span, so the span ends up with the
+// number of retries it took
+func partRetried(ctx context.Context, attempt int, err error) {
+	span := trace.SpanFromContext(ctx)
+
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("stitch.part.retries", attempt+1))
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+	}
+}
@@ -0,0 +1,1027 @@
+// Package stitch uploads large files to S3 as concurrent multipart uploads.
+package stitch
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const DefaultChunkSize = 15 * 1024 * 1024
+const MinimumChunkSize = 5 * 1024 * 1024
+
+// MaximumChunkSize is the largest part S3 accepts.
+const MaximumChunkSize = 5 * 1024 * 1024 * 1024
+
+// DefaultMultipartThreshold is a suggested MultipartThreshold, below which
+// the extra requests of a multipart upload outweigh its parallel parts.
+const DefaultMultipartThreshold = 16 * 1024 * 1024
+
+const DefaultConcurrency = 4
+
+// MaxParts is the most parts S3 allows in a single multipart upload.
+const MaxParts = 10000
+
+const abortTimeout = 30 * time.Second
+
+// ErrInvalidConfiguration is wrapped by the errors returned for an
+// UploadConfiguration or Uploader setting that can never succeed.
+var ErrInvalidConfiguration = errors.New("invalid configuration")
+
+// S3MultipartAPI is the set of S3 operations that make up a multipart upload,
+// with the same signatures as *s3.Client so either can be passed to an
+// Uploader. Resuming an upload additionally requires the client to implement
+// s3.ListPartsAPIClient.
+type S3MultipartAPI interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+var _ S3MultipartAPI = (*s3.Client)(nil)
+var _ s3.ListPartsAPIClient = (*s3.Client)(nil)
+var _ s3.ListMultipartUploadsAPIClient = (*s3.Client)(nil)
+
+// UploadConfiguration describes a single object to upload.
+type UploadConfiguration struct {
+	Bucket string
+	Key    string
+
+	// FilePath may be StdinPath to stream the upload from standard input,
+	// in which case its length isn't known until the stream ends. It is
+	// ignored by UploadReader.
+	FilePath  string
+	ChunkSize int64
+
+	// RequestPayer acknowledges the request charges of a Requester Pays
+	// bucket, which otherwise rejects every request with access denied.
+	RequestPayer bool
+
+	// ExpectedBucketOwner is the account id the bucket must belong to. S3
+	// denies every request when the bucket is owned by another account, so
+	// nothing is written to a bucket that was deleted and recreated by
+	// someone else.
+	ExpectedBucketOwner string
+
+	// AdaptiveChunkSize replaces ChunkSize with one chosen by
+	// AdaptiveChunkSize from the file's size. ChunkSize is still used when
+	// the size isn't known, as with standard input.
+	AdaptiveChunkSize bool
+
+	// AutoChunkSize raises ChunkSize for a file that would need more than
+	// PartLimit parts at it, instead of failing the upload. Each file of a
+	// batch is raised on its own, so only the large ones get larger parts.
+	AutoChunkSize bool
+
+	// UploadId resumes an existing multipart upload when set, skipping any
+	// parts that are already in S3.
+	UploadId string
+
+	// RestartMissingUpload starts a new upload when UploadId no longer
+	// exists, because it was aborted or expired, instead of failing with
+	// ErrUploadNotFound.
+	RestartMissingUpload bool
+
+	// KeepOnFailure leaves the multipart upload in S3 when uploading a part
+	// or completing fails, so it can be resumed with UploadId, instead of
+	// aborting it. S3 bills for the stored parts until the upload is resumed
+	// or aborted, so a lifecycle rule should clean up any that are forgotten.
+	KeepOnFailure bool
+
+	// NoComplete stores every part but leaves the multipart upload open
+	// instead of completing it, for another party to complete from the
+	// result's UploadId and Parts. The upload is always kept on failure as with
+	// KeepOnFailure, and even a small file is sent as a multipart upload. An
+	// empty source has no parts to leave, and Verify can't be used since there
+	// is no object yet.
+	NoComplete bool
+
+	// RequireAligned fails a resume whose existing parts don't all line up
+	// with ChunkSize, instead of uploading a mismatched last part again, so
+	// an object built across runs always keeps the same part boundaries.
+	RequireAligned bool
+
+	// StartPart numbers the parts from here instead of 1, so several writers
+	// can each upload a range of parts of one upload. When resuming with
+	// UploadId, parts outside this file's range are taken to belong to the
+	// other writers and are included when the upload is completed, with the
+	// completed object made of every part in order. A shared upload isn't
+	// aborted when this file fails, and Verify can't be used since the object
+	// holds more than the file.
+	StartPart int32
+
+	// MaxParts caps how many parts the file may be split into, failing the
+	// upload before any request when the chunk size would need more. Zero
+	// allows as many as S3 does.
+	MaxParts int64
+
+	// PartSizes, when set, are the sizes of the parts in order in place of
+	// splitting the file by ChunkSize, for benchmarks and for reproducing
+	// edge cases such as a tiny final part. They must add up to the size of
+	// the file, with every size but the last at least MinimumChunkSize. It
+	// only applies to a new upload of a whole file of known size, and
+	// replaces MultipartThreshold.
+	PartSizes []int64
+
+	// MultipartThreshold is the size below which a new upload of a file of
+	// known size is sent with a single PutObject, saving the requests that
+	// starting and completing a multipart upload take. It is capped at
+	// MaxMemory, as the whole object is held in memory. Zero only sends an
+	// empty file that way, which a multipart upload can't hold.
+	MultipartThreshold int64
+
+	// ChecksumAlgorithm has S3 validate a checksum of every part. It must be
+	// one of ChecksumAlgorithms, or empty to skip per-part checksums.
+	ChecksumAlgorithm types.ChecksumAlgorithm
+
+	// ChecksumMode is how the ChecksumAlgorithm checksum of each part is
+	// sent, ChecksumModePrecomputed when empty.
+	ChecksumMode ChecksumMode
+
+	// ContentMD5 sends the MD5 of every part so S3 rejects any corrupted in
+	// transit. It can't be combined with ChecksumAlgorithm, which covers the
+	// same ground and also stores the checksum with the object for later
+	// validation, so prefer that unless something expects Content-MD5.
+	ContentMD5 bool
+
+	// StorageClass of the created object. Empty uses the bucket default,
+	// which is normally STANDARD.
+	StorageClass types.StorageClass
+
+	// ACL is a canned ACL applied to the object, such as
+	// bucket-owner-full-control for cross-account writes.
+	ACL types.ObjectCannedACL
+
+	// ContentType of the object. When empty it is detected from the file
+	// extension or, failing that, the start of the file.
+	ContentType string
+
+	// CacheControl, ContentDisposition, and ContentEncoding are returned as
+	// the matching headers when the object is downloaded, for example
+	// ContentEncoding gzip for a payload that is already compressed. Like
+	// ContentType they are fixed when the multipart upload is created.
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+
+	// Gzip compresses the file as it is uploaded and sets ContentEncoding to
+	// gzip, with ContentType detected from the uncompressed file. The
+	// compressed size isn't known up front, so the upload is a stream and
+	// can't be resumed or skipped when present.
+	Gzip bool
+
+	// Expires is sent as the object's Expires header, the time a cached copy
+	// goes stale. S3 doesn't delete the object then; that takes a lifecycle
+	// rule on the bucket.
+	Expires time.Time
+
+	// Metadata is stored with the object as x-amz-meta-* headers.
+	Metadata map[string]string
+
+	// Tags are applied to the object, at most 10, for lifecycle rules and
+	// access control.
+	Tags map[string]string
+
+	// ServerSideEncryption and SSEKMSKeyId encrypt the object at rest. With
+	// aws:kms and no key id S3 uses the account's default KMS key. Encryption
+	// is fixed when the multipart upload is created and applies to every part,
+	// so these are ignored when resuming an existing upload.
+	ServerSideEncryption types.ServerSideEncryption
+	SSEKMSKeyId          string
+
+	// SSEKMSEncryptionContext is the KMS encryption context for aws:kms
+	// encryption, which keys with a context condition in their policy
+	// require.
+	SSEKMSEncryptionContext map[string]string
+
+	// ObjectLockMode and ObjectLockRetainUntil set the object's retention in
+	// a bucket with Object Lock enabled and must be given together.
+	// ObjectLockLegalHold places or explicitly omits a legal hold. Like
+	// encryption, these are fixed when the multipart upload is created.
+	ObjectLockMode        types.ObjectLockMode
+	ObjectLockRetainUntil time.Time
+	ObjectLockLegalHold   types.ObjectLockLegalHoldStatus
+
+	// SkipExisting leaves an object that is already in S3 alone when its size
+	// matches the file and, if it has SHA256MetadataKey metadata, so does its
+	// SHA-256. The client must also implement HeadObject.
+	SkipExisting bool
+
+	// IfMatch completes the upload only if the object still has this ETag,
+	// and IfNoneMatch set to * only if the object doesn't exist yet, so
+	// concurrent writers can't silently overwrite each other. Either way a
+	// conflicting write fails the upload with ErrPreconditionFailed.
+	IfMatch     string
+	IfNoneMatch string
+
+	// Verify checks the completed object's size and ETag, then downloads it
+	// and compares its SHA-256 with the local file. The client must also
+	// implement HeadObject and GetObject.
+	Verify bool
+}
+
+// UploadResult describes a completed upload. When Upload fails after the
+// multipart upload was created it also returns a partial result with the
+// UploadId and the parts that were uploaded, bytes counted in TotalBytes.
+// With NoComplete it describes the upload left open, without an ETag or
+// Location.
+type UploadResult struct {
+	UploadId   string
+	ETag       string
+	TotalBytes int64
+	PartCount  int
+
+	// ChunkSize is the part size the file was split by, after any
+	// AdaptiveChunkSize choice or AutoChunkSize raise, and FinalPartSize the
+	// size of the last part, which is the only one allowed to be smaller.
+	ChunkSize     int64
+	FinalPartSize int64
+
+	// Skipped is set when SkipExisting found the object already in S3, in
+	// which case nothing was uploaded.
+	Skipped bool
+
+	// SHA256 is the hex encoded SHA-256 of the file. The ETag of a multipart
+	// object is not a hash of its content, so this is the value to compare.
+	SHA256 string
+
+	// Parts are the parts in S3 by part number, those the object was
+	// completed from or, on failure, those a resume can reuse.
+	Parts []types.CompletedPart
+
+	// Location is the object's URL as returned by CompleteMultipartUpload.
+	// It is empty for objects sent with a single PutObject.
+	Location string
+
+	// PartTimings has a PartTiming for each part uploaded, in completion
+	// order, when Uploader.Timing is set.
+	PartTimings []PartTiming
+}
+
+// Uploader runs multipart uploads. The zero value is not usable; create one
+// with NewUploader.
+type Uploader struct {
+	Client S3MultipartAPI
+
+	Concurrency    int
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+
+	// PartTimeout bounds each S3 request. A part that times out is retried
+	// like any other transient failure. Zero disables the timeout.
+	PartTimeout time.Duration
+
+	// FileConcurrency is how many files UploadFiles uploads at once. The
+	// files share a budget of Concurrency parts in flight rather than each
+	// uploading Concurrency parts of its own.
+	FileConcurrency int
+
+	// MaxRate caps the combined upload throughput of all workers in bytes
+	// per second. Zero means unlimited.
+	MaxRate int64
+
+	// MaxMemory caps the chunk buffers held by a single upload in bytes.
+	// Concurrency is lowered for the upload when Concurrency times the chunk
+	// size would exceed it. Zero means unlimited.
+	MaxMemory int64
+
+	// ReadAhead is how many parts are read ahead of the part workers while
+	// they are all busy, so reading the source overlaps with uploading. Each
+	// takes a chunk buffer on top of Concurrency, and the count is lowered to
+	// fit within MaxMemory. Zero reads a part only once a worker is free.
+	ReadAhead int
+
+	// Logger receives lifecycle events at info, completed parts at debug, and
+	// failures at warn or error. Nil discards them.
+	Logger *slog.Logger
+
+	// Progress receives a progress bar redrawn as parts complete. Nil
+	// disables it.
+	Progress io.Writer
+
+	// ProgressFunc, when set, is called after each part completes with the
+	// part's size and the bytes uploaded so far, including parts reused when
+	// resuming. Calls are serialized even with concurrent workers, so it
+	// needs no locking of its own, but it must not block since the workers
+	// wait on it.
+	ProgressFunc func(partNum int32, bytesThisPart int, totalUploaded int64)
+
+	// PartFunc, when set, is called with the upload id and each part once it
+	// is stored in S3, including parts reused when resuming, for example to
+	// record what an interrupted upload leaves behind. Calls are serialized
+	// like ProgressFunc's and hold up the workers the same way.
+	PartFunc func(uploadId string, part types.CompletedPart)
+
+	// Metrics, when set, is told about every part request. Nil records
+	// nothing.
+	Metrics Metrics
+
+	// Tracer, when set, records a span for each upload with child spans for
+	// creating it, each part, and completing or aborting it. Nil records
+	// nothing.
+	Tracer trace.Tracer
+
+	// Clock times the delays between retries and the part timings. Nil uses
+	// the system clock.
+	Clock Clock
+
+	// Pause, when set, holds the workers back from starting new parts while
+	// it is paused, keeping the multipart upload open until it resumes.
+	Pause *PauseGate
+
+	// Timing measures how long each part spends being read and uploaded,
+	// logging each part at info and returning them in
+	// UploadResult.PartTimings.
+	Timing bool
+
+	// RefreshCredentials, when set, is called when S3 rejects a request
+	// because the credentials expired, such as a session token outlived by a
+	// long upload. The rejected request is sent again once it returns nil.
+	// It must be safe to call from several part workers at once.
+	RefreshCredentials func(ctx context.Context) error
+
+	limiterOnce sync.Once
+	limiter     *rate.Limiter
+}
+
+func NewUploader(client S3MultipartAPI) *Uploader {
+	return &Uploader{
+		Client:          client,
+		Concurrency:     DefaultConcurrency,
+		FileConcurrency: 1,
+		MaxRetries:      DefaultMaxRetries,
+		RetryBaseDelay:  DefaultRetryBaseDelay,
+		PartTimeout:     DefaultPartTimeout,
+	}
+}
+
+func (u *Uploader) Upload(ctx context.Context, cfg UploadConfiguration) (*UploadResult, error) {
+	return u.upload(ctx, cfg, nil)
+}
+
+// UploadReader uploads everything read from r, such as a generated archive,
+// instead of cfg.FilePath. size is the length r will produce, or -1 when it
+// isn't known, in which case each chunk is buffered until r ends and the
+// part count is only known at the end. When size is given, r producing more
+// or less data than that fails the upload. Every part but the last is a full
+// ChunkSize however r splits its reads. A reader can't be resumed, skipped
+// when present, or checked against an existing object, so UploadId and
+// SkipExisting must not be set.
+func (u *Uploader) UploadReader(ctx context.Context, cfg UploadConfiguration, r io.Reader, size int64) (*UploadResult, error) {
+	if err := u.validate(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfiguration, err)
+	}
+
+	if size < -1 {
+		return nil, fmt.Errorf("%w: size must be -1 or more, got %d", ErrInvalidConfiguration, size)
+	}
+
+	return u.uploadSource(ctx, cfg, readerSource(r, size), nil)
+}
+
+// upload is Upload with its parts drawn from budget, which is shared with
+// the other files of a batch
+func (u *Uploader) upload(ctx context.Context, cfg UploadConfiguration, budget partBudget) (*UploadResult, error) {
+	if err := u.validate(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfiguration, err)
+	}
+
+	if cfg.FilePath == "" {
+		return nil, fmt.Errorf("%w: a file path must be provided", ErrInvalidConfiguration)
+	}
+
+	src, err := openSource(cfg.FilePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer src.close()
+
+	return u.uploadSource(ctx, cfg, src, budget)
+}
+
+// uploadSource uploads src, which the caller closes, once cfg is validated,
+// within a span for the whole upload
+func (u *Uploader) uploadSource(ctx context.Context, cfg UploadConfiguration, src *source, budget partBudget) (*UploadResult, error) {
+	ctx, span := u.startSpan(ctx, "stitch.Upload", cfg, attribute.Int64("stitch.size", src.size))
+
+	result, err := u.uploadObject(ctx, cfg, src, budget)
+
+	if result != nil && span.IsRecording() {
+		span.SetAttributes(attribute.String("aws.s3.upload_id", result.UploadId), attribute.Int("stitch.parts", result.PartCount),
+			attribute.Int64("stitch.bytes", result.TotalBytes), attribute.Bool("stitch.skipped", result.Skipped))
+	}
+
+	endSpan(span, err)
+
+	return result, err
+}
+
+// uploadObject is uploadSource without the span
+func (u *Uploader) uploadObject(ctx context.Context, cfg UploadConfiguration, src *source, budget partBudget) (*UploadResult, error) {
+	// Whoever completes the upload may still use the parts stored so far
+	if cfg.NoComplete {
+		cfg.KeepOnFailure = true
+	}
+
+	if cfg.Gzip {
+		// The type is that of the content once decompressed, so it comes
+		// from the input before compressing it
+		contentType, err := resolveContentType(cfg, src)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ContentType = contentType
+		cfg.ContentEncoding = "gzip"
+
+		src = gzipSource(src)
+		defer src.close()
+	}
+
+	// Both compare what is already in S3 against the source, which needs a
+	// file that can be read again
+	if src.stream && (cfg.UploadId != "" || cfg.SkipExisting) {
+		return nil, fmt.Errorf("%w: cannot resume or skip an existing object when uploading from a stream", ErrInvalidConfiguration)
+	}
+
+	if cfg.AdaptiveChunkSize && src.size >= 0 {
+		cfg.ChunkSize = cfg.EffectiveChunkSize(src.size)
+		u.logger().Info("Chose chunk size", "chunkSize", cfg.ChunkSize, "size", src.size)
+	} else if cfg.AutoChunkSize && src.size >= 0 && len(cfg.PartSizes) == 0 {
+		if chunkSize := cfg.EffectiveChunkSize(src.size); chunkSize != cfg.ChunkSize {
+			u.logger().Info("Raising chunk size to stay within the part limit", "chunkSize", cfg.ChunkSize, "raisedTo", chunkSize, "maxParts", cfg.PartLimit())
+			cfg.ChunkSize = chunkSize
+		}
+	}
+
+	// Buffers are sized for the largest part
+	if len(cfg.PartSizes) > 0 {
+		if err := cfg.CheckPartSizesTotal(src.size); err != nil {
+			return nil, err
+		}
+
+		cfg.ChunkSize = cfg.EffectiveChunkSize(src.size)
+	}
+
+	if limit := cfg.PartLimit(); src.size >= 0 && PartCount(src.size, cfg.ChunkSize) > limit {
+		return nil, fmt.Errorf("%d bytes needs %d parts at a chunk size of %d, more than the limit of %d; use a chunk size of at least %d",
+			src.size, PartCount(src.size, cfg.ChunkSize), cfg.ChunkSize, limit, ChunkSizeForParts(src.size, limit))
+	}
+
+	if u.MaxMemory > 0 && cfg.ChunkSize > u.MaxMemory {
+		return nil, fmt.Errorf("a chunk size of %d doesn't fit in the memory limit of %d bytes", cfg.ChunkSize, u.MaxMemory)
+	}
+
+	if cfg.NoComplete && src.size == 0 {
+		return nil, fmt.Errorf("%w: an empty source has no parts to leave for completion", ErrInvalidConfiguration)
+	}
+
+	if u.PutsObject(cfg, src.size) {
+		return u.putObject(ctx, cfg, src, budget)
+	}
+
+	if cfg.SkipExisting && cfg.UploadId == "" {
+		exists, err := u.existingObject(ctx, cfg, src)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			u.logger().Info("Skipped, object is already present", "bucket", cfg.Bucket, "key", cfg.Key)
+			return &UploadResult{Skipped: true}, nil
+		}
+	}
+
+	uploadId := cfg.UploadId
+	var existingParts map[int32]types.Part
+	var otherParts []types.Part
+
+	if uploadId != "" {
+		parts, err := u.listUploadedParts(ctx, cfg, uploadId)
+
+		if errors.Is(err, ErrUploadNotFound) && cfg.RestartMissingUpload {
+			u.logger().Warn("Multipart upload no longer exists, starting a new one", "uploadId", uploadId)
+			uploadId, cfg.UploadId = "", ""
+		} else if err != nil {
+			return nil, err
+		} else {
+			existingParts, otherParts, err = reusableParts(parts, cfg.ChunkSize, src.size, cfg.firstPart(), cfg.RequireAligned)
+
+			if err != nil {
+				return nil, fmt.Errorf("cannot resume upload %s: %w", uploadId, err)
+			}
+
+			u.logger().Info("Resuming multipart upload", "bucket", cfg.Bucket, "key", cfg.Key, "uploadId", uploadId,
+				"existingParts", len(existingParts), "otherParts", len(otherParts))
+		}
+	}
+
+	if uploadId == "" {
+		contentType, err := resolveContentType(cfg, src)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// 1. Initiate multipart upload
+		spanCtx, span := u.startSpan(ctx, "CreateMultipartUpload", cfg)
+		reqCtx, cancel := u.requestContext(spanCtx)
+		createResp, err := u.Client.CreateMultipartUpload(reqCtx, &s3.CreateMultipartUploadInput{
+			Bucket:              &cfg.Bucket,
+			Key:                 &cfg.Key,
+			RequestPayer:        cfg.requestPayer(),
+			ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+			ChecksumAlgorithm:   cfg.ChecksumAlgorithm,
+			StorageClass:        cfg.StorageClass,
+			ACL:                 cfg.ACL,
+			ContentType:         &contentType,
+			Metadata:            cfg.Metadata,
+			Tagging:             encodeTags(cfg.Tags),
+
+			CacheControl:       optionalString(cfg.CacheControl),
+			ContentDisposition: optionalString(cfg.ContentDisposition),
+			ContentEncoding:    optionalString(cfg.ContentEncoding),
+			Expires:            optionalTime(cfg.Expires),
+
+			ServerSideEncryption:    cfg.ServerSideEncryption,
+			SSEKMSKeyId:             optionalString(cfg.SSEKMSKeyId),
+			SSEKMSEncryptionContext: encodeEncryptionContext(cfg.SSEKMSEncryptionContext),
+
+			ObjectLockMode:            cfg.ObjectLockMode,
+			ObjectLockRetainUntilDate: optionalTime(cfg.ObjectLockRetainUntil),
+			ObjectLockLegalHoldStatus: cfg.ObjectLockLegalHold,
+		})
+		cancel()
+		endSpan(span, err)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+		}
+
+		uploadId = *createResp.UploadId
+		u.logger().Info("Created multipart upload", "bucket", cfg.Bucket, "key", cfg.Key, "uploadId", uploadId,
+			"contentType", contentType, "storageClass", cfg.StorageClass, "acl", cfg.ACL)
+
+		if cfg.ACL != "" {
+			u.logger().Info("Bucket policies and Object Ownership settings may override the ACL", "acl", cfg.ACL)
+		}
+	}
+
+	uploaded, err := u.uploadParts(cfg, ctx, src, uploadId, existingParts, budget)
+
+	partial := &UploadResult{
+		UploadId:   uploadId,
+		TotalBytes: uploaded.size,
+		PartCount:  len(uploaded.parts),
+		ChunkSize:  cfg.ChunkSize,
+		Parts:      uploaded.parts,
+	}
+
+	if err != nil {
+		if ctx.Err() != nil && !cfg.KeepOnFailure {
+			u.logger().Warn("Interrupted, aborting upload", "uploadId", uploadId)
+		}
+
+		// Abort on failure, unless other writers are still using the upload
+		if cfg.UploadId != "" && cfg.firstPart() > 1 {
+			u.logger().Warn("Kept multipart upload shared with other writers", "uploadId", uploadId)
+		} else if cfg.KeepOnFailure {
+			u.logger().Warn("Kept multipart upload, resume it to finish the upload or abort it to stop paying for its parts",
+				"uploadId", uploadId, "parts", len(uploaded.parts))
+		} else {
+			u.abortUpload(ctx, cfg, uploadId)
+		}
+
+		return partial, fmt.Errorf("failed to upload parts: %w", err)
+	}
+
+	if len(otherParts) > 0 {
+		uploaded.parts = withOtherParts(uploaded.parts, otherParts, cfg.ChecksumAlgorithm)
+
+		for _, part := range otherParts {
+			if part.Size != nil {
+				uploaded.sizes[aws.ToInt32(part.PartNumber)] = *part.Size
+			}
+		}
+	}
+
+	// An empty stream is only found to be empty once read. The upload is
+	// left to whoever completes it, or to the caller that gave it.
+	if uploaded.size == 0 && len(uploaded.parts) == 0 {
+		if cfg.NoComplete {
+			return partial, fmt.Errorf("%w: an empty source has no parts to leave for completion", ErrInvalidConfiguration)
+		}
+
+		if cfg.UploadId != "" {
+			return partial, fmt.Errorf("%w: an empty source has no parts to add to upload %s", ErrInvalidConfiguration, uploadId)
+		}
+
+		u.abortUpload(ctx, cfg, uploadId)
+
+		return u.putObject(ctx, cfg, src, budget)
+	}
+
+	if err := checkPartSizes(uploaded.parts, uploaded.sizes); err != nil {
+		// The parts can't make a valid object, so there is nothing to resume
+		if cfg.UploadId != "" && cfg.firstPart() > 1 {
+			u.logger().Warn("Kept multipart upload shared with other writers", "uploadId", uploadId)
+		} else {
+			u.abortUpload(ctx, cfg, uploadId)
+		}
+
+		return partial, fmt.Errorf("cannot complete multipart upload: %w", err)
+	}
+
+	if cfg.NoComplete {
+		u.logger().Info("Left multipart upload open to be completed elsewhere", "bucket", cfg.Bucket, "key", cfg.Key,
+			"uploadId", uploadId, "parts", len(uploaded.parts))
+
+		return &UploadResult{
+			UploadId:   uploadId,
+			TotalBytes: uploaded.size,
+			PartCount:  len(uploaded.parts),
+			SHA256:     hex.EncodeToString(uploaded.checksum),
+			Parts:      uploaded.parts,
+
+			ChunkSize:     cfg.ChunkSize,
+			FinalPartSize: finalPartSize(uploaded.parts, uploaded.sizes),
+
+			PartTimings: uploaded.timings,
+		}, nil
+	}
+
+	// 3. Complete the upload
+	completeCtx, span := u.startSpan(ctx, "CompleteMultipartUpload", cfg, attribute.String("aws.s3.upload_id", uploadId))
+	completeResp, err := u.completeUpload(completeCtx, cfg, uploadId, uploaded.parts)
+	endSpan(span, err)
+
+	if err != nil {
+		// Every part is stored, so unless S3 rejected the completion outright
+		// the upload is kept for completing later by resuming it
+		if cfg.UploadId != "" && cfg.firstPart() > 1 {
+			u.logger().Warn("Kept multipart upload shared with other writers", "uploadId", uploadId)
+		} else if ctx.Err() == nil && !isRetryable(err) && !timedOut(ctx, err) && !cfg.KeepOnFailure {
+			u.abortUpload(ctx, cfg, uploadId)
+		} else {
+			u.logger().Warn("Kept multipart upload, resume it to complete the upload", "uploadId", uploadId)
+		}
+
+		return partial, fmt.Errorf("failed to complete multipart upload: %w", preconditionError(cfg, err))
+	}
+
+	result := &UploadResult{
+		UploadId:   uploadId,
+		ETag:       aws.ToString(completeResp.ETag),
+		TotalBytes: uploaded.size,
+		PartCount:  len(uploaded.parts),
+		SHA256:     hex.EncodeToString(uploaded.checksum),
+		Parts:      uploaded.parts,
+		Location:   aws.ToString(completeResp.Location),
+
+		ChunkSize:     cfg.ChunkSize,
+		FinalPartSize: finalPartSize(uploaded.parts, uploaded.sizes),
+
+		PartTimings: uploaded.timings,
+	}
+
+	if cfg.Verify {
+		if err := u.verifyObject(ctx, cfg, result); err != nil {
+			return result, err
+		}
+
+		if err := u.verifyChecksum(ctx, cfg, result); err != nil {
+			return result, err
+		}
+
+		u.logger().Info("Verified SHA-256", "bucket", cfg.Bucket, "key", cfg.Key, "sha256", result.SHA256)
+	}
+
+	return result, nil
+}
+
+// PartCount is how many parts a file of the given size is split into.
+func PartCount(size int64, chunkSize int64) int64 {
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// ChunkSizeForParts is the smallest chunk size that splits size into at most
+// maxParts parts, never going below MinimumChunkSize.
+func ChunkSizeForParts(size int64, maxParts int64) int64 {
+	return max((size+maxParts-1)/maxParts, MinimumChunkSize)
+}
+
+// Targets for AdaptiveChunkSize, trading fewer requests against the memory
+// held by Concurrency buffers of the chunk size
+const adaptiveTargetParts = 1000
+const adaptiveMaximumChunkSize = 512 * 1024 * 1024
+
+// AdaptiveChunkSize picks a chunk size that splits size into roughly 1000
+// parts, rounded up to a whole MiB and kept between MinimumChunkSize and
+// 512 MiB unless more is needed to stay within MaxParts.
+func AdaptiveChunkSize(size int64) int64 {
+	const mib = 1024 * 1024
+
+	chunkSize := (size + adaptiveTargetParts - 1) / adaptiveTargetParts
+	chunkSize = (chunkSize + mib - 1) / mib * mib
+	chunkSize = min(max(chunkSize, MinimumChunkSize), adaptiveMaximumChunkSize)
+
+	return max(chunkSize, ChunkSizeForParts(size, MaxParts))
+}
+
+func (u *Uploader) validate(cfg UploadConfiguration) error {
+	if u.Client == nil {
+		return errors.New("uploader has no S3 client")
+	}
+
+	if cfg.Bucket == "" || cfg.Key == "" {
+		return errors.New("bucket and key must both be provided")
+	}
+
+	if cfg.ChunkSize < MinimumChunkSize {
+		return fmt.Errorf("chunk size must be at least %d bytes", MinimumChunkSize)
+	}
+
+	if cfg.ChunkSize > MaximumChunkSize {
+		return fmt.Errorf("chunk size must be at most %d bytes", MaximumChunkSize)
+	}
+
+	for key := range cfg.Metadata {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("metadata keys must not be empty")
+		}
+	}
+
+	if err := validateTags(cfg.Tags); err != nil {
+		return err
+	}
+
+	if cfg.ChecksumAlgorithm != "" {
+		if _, err := ParseChecksumAlgorithm(string(cfg.ChecksumAlgorithm)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ChecksumMode != "" {
+		if _, err := ParseChecksumMode(string(cfg.ChecksumMode)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ChecksumMode == ChecksumModeTrailer && cfg.ChecksumAlgorithm == "" {
+		return errors.New("a trailing checksum requires a checksum algorithm")
+	}
+
+	if cfg.ContentMD5 && cfg.ChecksumAlgorithm != "" {
+		return errors.New("content MD5 can't be combined with a checksum algorithm")
+	}
+
+	if cfg.StorageClass != "" {
+		if _, err := ParseStorageClass(string(cfg.StorageClass)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ACL != "" {
+		if _, err := ParseCannedACL(string(cfg.ACL)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ServerSideEncryption != "" {
+		if _, err := ParseServerSideEncryption(string(cfg.ServerSideEncryption)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.SSEKMSKeyId != "" && cfg.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		return errors.New("a KMS key id requires aws:kms server-side encryption")
+	}
+
+	if len(cfg.SSEKMSEncryptionContext) > 0 && cfg.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		return errors.New("a KMS encryption context requires aws:kms server-side encryption")
+	}
+
+	if err := validateObjectLock(cfg); err != nil {
+		return err
+	}
+
+	if err := validatePreconditions(cfg); err != nil {
+		return err
+	}
+
+	if err := validatePartSizes(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Gzip && cfg.ContentEncoding != "" && cfg.ContentEncoding != "gzip" {
+		return fmt.Errorf("gzip compression can't be combined with a content encoding of %s", cfg.ContentEncoding)
+	}
+
+	if !cfg.Expires.IsZero() && !cfg.Expires.After(time.Now()) {
+		return errors.New("expiry must be in the future")
+	}
+
+	if cfg.ExpectedBucketOwner != "" && !isAccountId(cfg.ExpectedBucketOwner) {
+		return fmt.Errorf("expected bucket owner must be a 12 digit account id, got %q", cfg.ExpectedBucketOwner)
+	}
+
+	if cfg.MultipartThreshold < 0 || cfg.MultipartThreshold > MaximumChunkSize {
+		return fmt.Errorf("multipart threshold must be between 0 and %d, the largest PutObject S3 accepts", MaximumChunkSize)
+	}
+
+	if cfg.StartPart < 0 || cfg.StartPart > MaxParts {
+		return fmt.Errorf("start part must be between 1 and %d", MaxParts)
+	}
+
+	if cfg.MaxParts < 0 || cfg.MaxParts > MaxParts {
+		return fmt.Errorf("max parts must be between 1 and %d", MaxParts)
+	}
+
+	if cfg.StartPart > 1 && cfg.RestartMissingUpload {
+		return errors.New("a missing upload can't be restarted with a start part after 1, its other writers would still use the old one")
+	}
+
+	if cfg.StartPart > 1 && cfg.Verify {
+		return errors.New("verify can't be used with a start part after 1")
+	}
+
+	if cfg.NoComplete && cfg.Verify {
+		return errors.New("verify can't be used without completing the upload")
+	}
+
+	if u.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	if u.ReadAhead < 0 {
+		return errors.New("read ahead must not be negative")
+	}
+
+	if u.MaxMemory < 0 {
+		return errors.New("max memory must not be negative")
+	}
+
+	if u.MaxRetries < 0 {
+		return errors.New("max retries must not be negative")
+	}
+
+	return nil
+}
+
+// abortUpload uses its own context since the upload context may already be
+// cancelled by the time we get here
+func (u *Uploader) abortUpload(ctx context.Context, cfg UploadConfiguration, uploadId string) {
+	// The abort has to go ahead when ctx was cancelled, and only keeps it for
+	// its span
+	ctx, span := u.startSpan(context.WithoutCancel(ctx), "AbortMultipartUpload", cfg, attribute.String("aws.s3.upload_id", uploadId))
+
+	ctx, cancel := context.WithTimeout(ctx, abortTimeout)
+	defer cancel()
+
+	_, err := u.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+		UploadId:            &uploadId,
+	})
+	endSpan(span, err)
+
+	if err != nil {
+		u.logger().Error("Failed to abort multipart upload", "uploadId", uploadId, "error", err)
+		return
+	}
+
+	u.logger().Info("Aborted multipart upload", "uploadId", uploadId)
+}
+
+// EffectiveChunkSize is the chunk size a file of the given size is split by,
+// ChunkSize unless AdaptiveChunkSize picks one for it or AutoChunkSize raises
+// it. With PartSizes it is the largest of them.
+func (cfg UploadConfiguration) EffectiveChunkSize(size int64) int64 {
+	if len(cfg.PartSizes) > 0 {
+		return slices.Max(cfg.PartSizes)
+	}
+
+	if size < 0 {
+		return cfg.ChunkSize
+	}
+
+	if cfg.AdaptiveChunkSize {
+		return max(AdaptiveChunkSize(size), ChunkSizeForParts(size, cfg.PartLimit()))
+	}
+
+	if cfg.AutoChunkSize && PartCount(size, cfg.ChunkSize) > cfg.PartLimit() {
+		return ChunkSizeForParts(size, cfg.PartLimit())
+	}
+
+	return cfg.ChunkSize
+}
+
+// PutsObject reports whether Upload sends size bytes with cfg as a single
+// PutObject instead of a multipart upload. A multipart upload can't be
+// completed without parts, so an empty file is put, like any below the
+// multipart threshold or the memory limit. Only a new upload of the whole
+// file can be replaced, and a compressed one never is, as its size isn't
+// known until it has been read.
+func (u *Uploader) PutsObject(cfg UploadConfiguration, size int64) bool {
+	if cfg.Gzip || size < 0 || cfg.UploadId != "" || cfg.firstPart() != 1 || cfg.NoComplete {
+		return false
+	}
+
+	return size == 0 || size < u.multipartThreshold(cfg) && len(cfg.PartSizes) == 0
+}
+
+// multipartThreshold is cfg.MultipartThreshold within the memory limit
+func (u *Uploader) multipartThreshold(cfg UploadConfiguration) int64 {
+	if u.MaxMemory > 0 {
+		return min(cfg.MultipartThreshold, u.MaxMemory)
+	}
+
+	return cfg.MultipartThreshold
+}
+
+// firstPart is the number of the file's first part, StartPart or 1 when unset
+func (cfg UploadConfiguration) firstPart() int32 {
+	return max(cfg.StartPart, 1)
+}
+
+// PartLimit is the most parts the file may be split into, the smaller of
+// MaxParts and the part numbers left from StartPart.
+func (cfg UploadConfiguration) PartLimit() int64 {
+	limit := int64(MaxParts - cfg.firstPart() + 1)
+
+	if cfg.MaxParts > 0 {
+		limit = min(limit, cfg.MaxParts)
+	}
+
+	return limit
+}
+
+func (cfg UploadConfiguration) requestPayer() types.RequestPayer {
+	if cfg.RequestPayer {
+		return types.RequestPayerRequester
+	}
+
+	return ""
+}
+
+// isAccountId reports whether id is an AWS account id, which is 12 digits
+func isAccountId(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func optionalTime(value time.Time) *time.Time {
+	if value.IsZero() {
+		return nil
+	}
+
+	return &value
+}
+
+// optionalString leaves unset options out of the request entirely rather than
+// sending an empty value
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+func (u *Uploader) logger() *slog.Logger {
+	if u.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+
+	return u.Logger
+}
@@ -0,0 +1,89 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestUploadRoundTrip(t *testing.T) {
+	data := testData(3*MinimumChunkSize + 1234)
+	path := writeTestFile(t, "data.bin", data)
+
+	client := newFakeS3()
+	u := newTestUploader(client)
+
+	result, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if result.PartCount != 4 || result.TotalBytes != int64(len(data)) {
+		t.Errorf("got %d parts of %d bytes, want 4 parts of %d bytes", result.PartCount, result.TotalBytes, len(data))
+	}
+
+	object, ok := client.object("key")
+
+	if !ok || !bytes.Equal(object, data) {
+		t.Fatalf("object doesn't match the file")
+	}
+
+	if n := client.count("UploadPart"); n != 4 {
+		t.Errorf("sent %d parts, want 4", n)
+	}
+
+	calls := client.recorded()
+	if calls[0] != "CreateMultipartUpload" || calls[len(calls)-1] != "CompleteMultipartUpload" {
+		t.Errorf("calls %v don't start by creating the upload and end by completing it", calls)
+	}
+}
+
+func TestUploadAbortsOnFailedPart(t *testing.T) {
+	path := writeTestFile(t, "data.bin", testData(3*MinimumChunkSize))
+
+	client := newFakeS3()
+	client.failPart(2, -1, apiError("AccessDenied"))
+	u := newTestUploader(client)
+
+	result, err := u.Upload(context.Background(), UploadConfiguration{Bucket: "bucket", Key: "key", FilePath: path, ChunkSize: MinimumChunkSize})
+
+	if err == nil {
+		t.Fatal("upload succeeded despite a failing part")
+	}
+
+	if result == nil || result.UploadId == "" {
+		t.Fatalf("got no partial result for the failed upload")
+	}
+
+	if slices.Contains(client.recorded(), "CompleteMultipartUpload") {
+		t.Error("failed upload was completed")
+	}
+
+	if client.count("AbortMultipartUpload") != 1 || client.openUploads() != 0 {
+		t.Errorf("failed upload wasn't aborted, calls %v", client.recorded())
+	}
+}
+
+func TestChunkSizeBounds(t *testing.T) {
+	u := newTestUploader(newFakeS3())
+
+	for _, tc := range []struct {
+		chunkSize int64
+		valid     bool
+	}{
+		{MinimumChunkSize - 1, false},
+		{MinimumChunkSize, true},
+		{MinimumChunkSize + 1, true},
+		{MaximumChunkSize - 1, true},
+		{MaximumChunkSize, true},
+		{MaximumChunkSize + 1, false},
+	} {
+		err := u.validate(UploadConfiguration{Bucket: "bucket", Key: "key", ChunkSize: tc.chunkSize})
+
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("chunk size %d: got error %v, want valid %t", tc.chunkSize, err, tc.valid)
+		}
+	}
+}
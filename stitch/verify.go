@@ -0,0 +1,177 @@
+package stitch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+type getObjectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+type headObjectAPI interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// ErrVerificationFailed is wrapped by the errors Verify returns when the
+// uploaded object doesn't match the source.
+var ErrVerificationFailed = errors.New("verification failed")
+
+// SHA256MetadataKey is the object metadata key checked by SkipExisting for a
+// stored SHA-256 of the object's content.
+const SHA256MetadataKey = "sha256"
+
+// existingObject reports whether the object is already in S3 with the same
+// size as the source and, when the object records one, the same SHA-256
+func (u *Uploader) existingObject(ctx context.Context, cfg UploadConfiguration, src *source) (bool, error) {
+	if src.stream {
+		return false, errors.New("cannot check for an existing object when uploading from a stream")
+	}
+
+	client, ok := u.Client.(headObjectAPI)
+
+	if !ok {
+		return false, errors.New("cannot check for an existing object: client does not implement HeadObject")
+	}
+
+	reqCtx, cancel := u.requestContext(ctx)
+	defer cancel()
+
+	headResp, err := client.HeadObject(reqCtx, &s3.HeadObjectInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+	})
+
+	if err != nil {
+		var notFound *types.NotFound
+		var apiErr smithy.APIError
+
+		// A missing object is the normal case and means the upload goes ahead
+		if errors.As(err, &notFound) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to check for an existing object: %w", err)
+	}
+
+	if aws.ToInt64(headResp.ContentLength) != src.size {
+		return false, nil
+	}
+
+	stored, ok := headResp.Metadata[SHA256MetadataKey]
+
+	if !ok {
+		return true, nil
+	}
+
+	local, err := fileSHA256(cfg.FilePath, src.size)
+
+	if err != nil {
+		return false, err
+	}
+
+	return local == stored, nil
+}
+
+// fileSHA256 hashes the first size bytes of the file, the part an upload
+// that opened it at that size would send
+func fileSHA256(filePath string, size int64) (string, error) {
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.CopyN(hash, f, size); err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyObject checks the completed object exists with the size and ETag we
+// expect, catching truncated or missing objects before the slower download
+func (u *Uploader) verifyObject(ctx context.Context, cfg UploadConfiguration, result *UploadResult) error {
+	client, ok := u.Client.(headObjectAPI)
+
+	if !ok {
+		return errors.New("cannot verify upload: client does not implement HeadObject")
+	}
+
+	reqCtx, cancel := u.requestContext(ctx)
+	defer cancel()
+
+	headResp, err := client.HeadObject(reqCtx, &s3.HeadObjectInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to find uploaded object: %w", err)
+	}
+
+	if size := aws.ToInt64(headResp.ContentLength); size != result.TotalBytes {
+		return fmt.Errorf("%w: uploaded %d bytes but the object is %d bytes", ErrVerificationFailed, result.TotalBytes, size)
+	}
+
+	if etag := aws.ToString(headResp.ETag); etag != result.ETag {
+		return fmt.Errorf("%w: completed upload returned ETag %s but the object has %s", ErrVerificationFailed, result.ETag, etag)
+	}
+
+	return nil
+}
+
+// verifyChecksum re-downloads the uploaded object and compares its SHA-256 to
+// the one computed while reading the local file
+func (u *Uploader) verifyChecksum(ctx context.Context, cfg UploadConfiguration, result *UploadResult) error {
+	client, ok := u.Client.(getObjectAPI)
+
+	if !ok {
+		return errors.New("cannot verify upload: client does not implement GetObject")
+	}
+
+	getResp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:              &cfg.Bucket,
+		Key:                 &cfg.Key,
+		RequestPayer:        cfg.requestPayer(),
+		ExpectedBucketOwner: optionalString(cfg.ExpectedBucketOwner),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to download object for verification: %w", err)
+	}
+
+	defer getResp.Body.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, getResp.Body); err != nil {
+		return fmt.Errorf("failed to download object for verification: %w", err)
+	}
+
+	remote := hex.EncodeToString(hash.Sum(nil))
+
+	if remote != result.SHA256 {
+		return fmt.Errorf("%w: local SHA-256 %s does not match uploaded object %s", ErrVerificationFailed, result.SHA256, remote)
+	}
+
+	return nil
+}
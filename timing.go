@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/awarrington0895/stitch/stitch"
+)
+
+// printTimingSummary writes the spread of part upload times and how the total
+// time divides between reading and uploading, to show whether the source or
+// the network is the bottleneck
+func printTimingSummary(w io.Writer, timings []stitch.PartTiming) {
+	if len(timings) == 0 {
+		return
+	}
+
+	uploads := make([]time.Duration, 0, len(timings))
+	var read, upload time.Duration
+
+	for _, t := range timings {
+		uploads = append(uploads, t.Upload)
+		read += t.Read
+		upload += t.Upload
+	}
+
+	slices.Sort(uploads)
+
+	fmt.Fprintf(w, "Part upload time over %d parts: min %v, p50 %v, p95 %v, max %v\n", len(uploads),
+		round(uploads[0]), round(percentile(uploads, 50)), round(percentile(uploads, 95)), round(uploads[len(uploads)-1]))
+	fmt.Fprintf(w, "Total read time %v, total upload time %v\n", round(read), round(upload))
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "github.com/awarrington0895/stitch/stitch"
+
+// Bounds for -tune, keeping the chunk buffers of every worker within
+// tuneMemory
+const maxTunedConcurrency = 64
+const tuneMemory = 1024 * 1024 * 1024
+
+// tuning is the chunk size and concurrency -tune picked for a file
+type tuning struct {
+	chunkSize   int64
+	concurrency int
+}
+
+// tuneUpload picks a chunk size of roughly 1000 parts, like -auto, and enough
+// workers to keep cpus busy without starting more than there are parts or
+// holding more than tuneMemory in buffers
+func tuneUpload(size int64, maxParts int64, cpus int) tuning {
+	chunkSize := max(stitch.AdaptiveChunkSize(size), stitch.ChunkSizeForParts(size, maxParts))
+	parts := max(stitch.PartCount(size, chunkSize), 1)
+
+	concurrency := int(min(parts, int64(min(max(2*cpus, 4), maxTunedConcurrency))))
+	concurrency = max(min(concurrency, int(tuneMemory/chunkSize)), 1)
+
+	return tuning{chunkSize: chunkSize, concurrency: concurrency}
+}